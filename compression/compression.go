@@ -0,0 +1,47 @@
+package compression
+
+import (
+	"fmt"
+)
+
+// Available encodings of the packed display buffer. Like HTTP's identity content coding,
+// None leaves the data unchanged.
+const (
+	None       = ""
+	Identity   = "identity"
+	PackBits   = "packbits"
+	Heatshrink = "heatshrink"
+)
+
+// Heatshrink parameters. Decoders have to be configured with the same values.
+const (
+	HeatshrinkWindow    = 8
+	HeatshrinkLookahead = 4
+)
+
+// Validate returns an error for unknown encodings
+func Validate(encoding string) error {
+	switch encoding {
+	case None, Identity, PackBits, Heatshrink:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %s", encoding)
+}
+
+// Compressed returns true if the encoding changes the data
+func Compressed(encoding string) bool {
+	return encoding != None && encoding != Identity
+}
+
+// Encode compresses data with the given encoding
+func Encode(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case None, Identity:
+		return data, nil
+	case PackBits:
+		return encodePackBits(data), nil
+	case Heatshrink:
+		return encodeHeatshrink(data, HeatshrinkWindow, HeatshrinkLookahead), nil
+	}
+	return nil, Validate(encoding)
+}
@@ -0,0 +1,127 @@
+package compression
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func decodePackBits(data []byte) []byte {
+	out := []byte{}
+	for i := 0; i < len(data); {
+		n := int(int8(data[i]))
+		i++
+		switch {
+		case n >= 0:
+			out = append(out, data[i:i+n+1]...)
+			i += n + 1
+		case n != -128:
+			out = append(out, bytes.Repeat(data[i:i+1], 1-n)...)
+			i++
+		}
+	}
+	return out
+}
+
+// decodeHeatshrink follows the heatshrink decoder, which starts with a zeroed window
+func decodeHeatshrink(data []byte, window uint, lookahead uint) []byte {
+	position := uint(0)
+	read := func(bits uint) (int, bool) {
+		if position+bits > uint(len(data))*8 {
+			return 0, false
+		}
+		v := 0
+		for i := uint(0); i < bits; i++ {
+			v = v<<1 | int(data[(position+i)/8]>>(7-(position+i)%8)&1)
+		}
+		position += bits
+		return v, true
+	}
+
+	out := []byte{}
+	for {
+		tag, ok := read(1)
+		if !ok {
+			return out
+		}
+		if tag == 1 {
+			literal, ok := read(8)
+			if !ok {
+				return out
+			}
+			out = append(out, byte(literal))
+			continue
+		}
+		index, ok := read(window)
+		if !ok {
+			return out
+		}
+		count, ok := read(lookahead)
+		if !ok {
+			return out
+		}
+		for i := 0; i <= count; i++ {
+			out = append(out, out[len(out)-index-1])
+		}
+	}
+}
+
+func TestPackBits(t *testing.T) {
+	// The example of Apple's Technical Note TN1023
+	input := []byte{0xaa, 0xaa, 0xaa, 0x80, 0x00, 0x2a, 0xaa, 0xaa, 0xaa, 0xaa, 0x80, 0x00, 0x2a, 0x22,
+		0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}
+	expected := []byte{0xfe, 0xaa, 0x02, 0x80, 0x00, 0x2a, 0xfd, 0xaa, 0x03, 0x80, 0x00, 0x2a, 0x22, 0xf7, 0xaa}
+	if output, _ := Encode(PackBits, input); !bytes.Equal(output, expected) {
+		t.Errorf("Got %x instead of %x", output, expected)
+	}
+}
+
+func TestHeatshrink(t *testing.T) {
+	// A literal followed by a back-reference with offset 1 and length 4
+	expected := []byte{0xb0, 0x80, 0x0c}
+	if output, _ := Encode(Heatshrink, []byte("aaaaa")); !bytes.Equal(output, expected) {
+		t.Errorf("Got %x instead of %x", output, expected)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 1000)
+	rng.Read(random)
+	// Long runs with some noise, like a packed image
+	image := bytes.Repeat([]byte{0xff}, 48000)
+	for i := 0; i < 500; i++ {
+		image[rng.Intn(len(image))] = byte(rng.Intn(256))
+	}
+
+	inputs := [][]byte{{}, {0x42}, []byte("abcabcdabcdeabcdefabcdefgabcdefgh"), bytes.Repeat([]byte{0}, 300), random, image}
+	decoders := map[string]func([]byte) []byte{
+		PackBits: decodePackBits,
+		Heatshrink: func(data []byte) []byte {
+			return decodeHeatshrink(data, HeatshrinkWindow, HeatshrinkLookahead)
+		},
+	}
+	for encoding, decode := range decoders {
+		for _, input := range inputs {
+			output, err := Encode(encoding, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decode(output), input) {
+				t.Errorf("%s: round trip of %d bytes failed", encoding, len(input))
+			}
+		}
+		if output, _ := Encode(encoding, image); len(output) > len(image)/8 {
+			t.Errorf("%s: the image was only compressed to %d bytes", encoding, len(output))
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if Validate("gzip") == nil {
+		t.Error("Unknown encodings should be rejected")
+	}
+	if _, err := Encode("gzip", nil); err == nil {
+		t.Error("Unknown encodings should be rejected")
+	}
+}
@@ -0,0 +1,70 @@
+package compression
+
+// bitWriter appends bits to a byte slice, most significant bit first
+type bitWriter struct {
+	data    []byte
+	current byte
+	count   uint
+}
+
+func (w *bitWriter) write(value int, bits uint) {
+	for i := bits; i > 0; i-- {
+		w.current = w.current<<1 | byte(value>>(i-1)&1)
+		w.count++
+		if w.count == 8 {
+			w.data = append(w.data, w.current)
+			w.current = 0
+			w.count = 0
+		}
+	}
+}
+
+// flush pads the last byte with 0 bits
+func (w *bitWriter) flush() []byte {
+	if w.count > 0 {
+		w.data = append(w.data, w.current<<(8-w.count))
+		w.current = 0
+		w.count = 0
+	}
+	return w.data
+}
+
+// encodeHeatshrink compresses data in the format of the heatshrink library with a window of
+// 2^window bytes and back-references of up to 2^lookahead bytes. A 1 bit is followed by a
+// literal byte, a 0 bit by the offset-1 of a back-reference in window bits and its length-1
+// in lookahead bits.
+func encodeHeatshrink(data []byte, window uint, lookahead uint) []byte {
+	windowSize := 1 << window
+	maxLength := 1 << lookahead
+	// Back-references shorter than this take more bits than literals
+	minLength := int(1+window+lookahead)/8 + 1
+
+	w := bitWriter{}
+	for i := 0; i < len(data); {
+		bestLength, bestOffset := 0, 0
+		for offset := 1; offset <= windowSize && offset <= i; offset++ {
+			length := 0
+			for length < maxLength && i+length < len(data) && data[i+length-offset] == data[i+length] {
+				length++
+			}
+			if length > bestLength {
+				bestLength, bestOffset = length, offset
+				if length == maxLength {
+					break
+				}
+			}
+		}
+
+		if bestLength >= minLength {
+			w.write(0, 1)
+			w.write(bestOffset-1, window)
+			w.write(bestLength-1, lookahead)
+			i += bestLength
+		} else {
+			w.write(1, 1)
+			w.write(int(data[i]), 8)
+			i++
+		}
+	}
+	return w.flush()
+}
@@ -0,0 +1,35 @@
+package compression
+
+// maxPackBitsLength is the maximum number of bytes a run or literal can contain
+const maxPackBitsLength = 128
+
+// encodePackBits compresses data with the PackBits run-length encoding. Every packet starts
+// with a header byte n. For 0 <= n <= 127, n+1 literal bytes follow. For -127 <= n <= -1,
+// the next byte is repeated 1-n times.
+func encodePackBits(data []byte) []byte {
+	out := []byte{}
+	for i := 0; i < len(data); {
+		run := 1
+		for i+run < len(data) && run < maxPackBitsLength && data[i+run] == data[i] {
+			run++
+		}
+		if run >= 2 {
+			out = append(out, byte(1-run), data[i])
+			i += run
+			continue
+		}
+
+		// Collect literals until the next run of at least three bytes, which is
+		// cheaper as a run even if it interrupts the literals
+		start := i
+		for i < len(data) && i-start < maxPackBitsLength {
+			if i+2 < len(data) && data[i] == data[i+1] && data[i] == data[i+2] {
+				break
+			}
+			i++
+		}
+		out = append(out, byte(i-start-1))
+		out = append(out, data[start:i]...)
+	}
+	return out
+}
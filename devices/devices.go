@@ -0,0 +1,238 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dschanoeh/what-to-wear/compression"
+	"github.com/dschanoeh/what-to-wear/imaging"
+)
+
+const (
+	DefaultLayout      = "index.gohtml"
+	DefaultProfile     = "default"
+	DefaultPixelFormat = imaging.PixelFormat1bpp
+	DefaultVariantID   = "default"
+)
+
+type Location struct {
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("(%.3f, %.3f)", l.Latitude, l.Longitude)
+}
+
+type DeviceConfig struct {
+	Name         string    `yaml:"name"`
+	MQTTClientID string    `yaml:"mqtt_client_id"`
+	Layout       string    `yaml:"layout"`
+	Location     *Location `yaml:"location"`
+	Profile      string    `yaml:"profile"`
+	PixelFormat  string    `yaml:"pixel_format"`
+	MQTTTopic    string    `yaml:"mqtt_topic"`
+	// Compression of the image data published to MQTTTopic. If unset, the compression
+	// of the MQTT configuration is used.
+	Compression string `yaml:"compression"`
+}
+
+// Variant is a distinct combination of layout, profile, location and pixel format
+// that needs to be rendered. Devices sharing these settings share a variant.
+type Variant struct {
+	ID          string
+	Layout      string
+	Profile     string
+	Location    Location
+	PixelFormat string
+	Version     string
+	devices     []*Device
+}
+
+type Device struct {
+	Config         DeviceConfig
+	Variant        *Variant
+	LastFetch      time.Time
+	FetchedVersion string
+}
+
+type Registry struct {
+	mutex    sync.RWMutex
+	devices  map[string]*Device
+	variants []*Variant
+}
+
+// New creates a registry for the given devices. Unset device settings fall back to
+// the defaults and defaultLocation. The default variant is always present so
+// clients that don't identify themselves can still be served.
+func New(configs []DeviceConfig, defaultLocation Location, baseTopic string) (*Registry, error) {
+	r := Registry{devices: map[string]*Device{}}
+	r.variants = append(r.variants, &Variant{
+		ID:          DefaultVariantID,
+		Layout:      DefaultLayout,
+		Profile:     DefaultProfile,
+		Location:    defaultLocation,
+		PixelFormat: DefaultPixelFormat,
+	})
+
+	for _, c := range configs {
+		if c.Name == "" {
+			return nil, errors.New("device without a name")
+		}
+		if _, ok := r.devices[c.Name]; ok {
+			return nil, fmt.Errorf("duplicate device name %s", c.Name)
+		}
+		if c.Layout == "" {
+			c.Layout = DefaultLayout
+		}
+		if c.Profile == "" {
+			c.Profile = DefaultProfile
+		}
+		if c.Location == nil {
+			l := defaultLocation
+			c.Location = &l
+		}
+		if c.PixelFormat == "" {
+			c.PixelFormat = DefaultPixelFormat
+		}
+		if _, err := imaging.BitsPerPixel(c.PixelFormat); err != nil {
+			return nil, fmt.Errorf("device %s: %v", c.Name, err)
+		}
+		if err := compression.Validate(c.Compression); err != nil {
+			return nil, fmt.Errorf("device %s: %v", c.Name, err)
+		}
+		if c.MQTTTopic == "" {
+			c.MQTTTopic = fmt.Sprintf("%s/devices/%s", baseTopic, c.Name)
+		}
+
+		d := Device{Config: c}
+		d.Variant = r.variantFor(c.Layout, c.Profile, *c.Location, c.PixelFormat)
+		d.Variant.devices = append(d.Variant.devices, &d)
+		r.devices[c.Name] = &d
+	}
+
+	return &r, nil
+}
+
+func (r *Registry) variantFor(layout string, profile string, location Location, pixelFormat string) *Variant {
+	for _, v := range r.variants {
+		if v.Layout == layout && v.Profile == profile && v.Location == location && v.PixelFormat == pixelFormat {
+			return v
+		}
+	}
+	v := Variant{
+		ID:          fmt.Sprintf("variant-%d", len(r.variants)),
+		Layout:      layout,
+		Profile:     profile,
+		Location:    location,
+		PixelFormat: pixelFormat,
+	}
+	r.variants = append(r.variants, &v)
+	return &v
+}
+
+// Variants returns all variants that have to be rendered, the default variant first.
+func (r *Registry) Variants() []*Variant {
+	return r.variants
+}
+
+// Variant returns the variant with the given ID or nil if it doesn't exist.
+func (r *Registry) Variant(id string) *Variant {
+	for _, v := range r.variants {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// Devices returns all devices sorted by name.
+func (r *Registry) Devices() []*Device {
+	devices := make([]*Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Config.Name < devices[j].Config.Name
+	})
+	return devices
+}
+
+// DevicesOf returns the devices that display the given variant.
+func (r *Registry) DevicesOf(v *Variant) []*Device {
+	return v.devices
+}
+
+// Identify returns the device a request identifies itself as through the
+// 'device' or 'client_id' query parameters. If neither is set, nil is returned
+// without an error.
+func (r *Registry) Identify(query url.Values) (*Device, error) {
+	if name := query.Get("device"); name != "" {
+		d, ok := r.devices[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown device %s", name)
+		}
+		return d, nil
+	}
+
+	if clientID := query.Get("client_id"); clientID != "" {
+		for _, d := range r.devices {
+			if d.Config.MQTTClientID == clientID {
+				return d, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown MQTT client ID %s", clientID)
+	}
+
+	return nil, nil
+}
+
+// SetVersion updates the image version that is currently available for a variant.
+func (r *Registry) SetVersion(v *Variant, version string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	v.Version = version
+}
+
+// RecordFetch remembers that a device has fetched the given image version.
+func (r *Registry) RecordFetch(d *Device, version string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	d.LastFetch = time.Now()
+	d.FetchedVersion = version
+}
+
+// DeviceStatus is a snapshot of a device's state for display purposes.
+type DeviceStatus struct {
+	Config         DeviceConfig
+	VariantID      string
+	CurrentVersion string
+	FetchedVersion string
+	LastFetch      time.Time
+}
+
+func (s DeviceStatus) UpToDate() bool {
+	return s.FetchedVersion != "" && s.FetchedVersion == s.CurrentVersion
+}
+
+// Status returns a snapshot of all devices sorted by name.
+func (r *Registry) Status() []DeviceStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	status := []DeviceStatus{}
+	for _, d := range r.Devices() {
+		status = append(status, DeviceStatus{
+			Config:         d.Config,
+			VariantID:      d.Variant.ID,
+			CurrentVersion: d.Variant.Version,
+			FetchedVersion: d.FetchedVersion,
+			LastFetch:      d.LastFetch,
+		})
+	}
+	return status
+}
@@ -0,0 +1,78 @@
+package devices
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestVariantsAreShared(t *testing.T) {
+	configs := []DeviceConfig{
+		{Name: "kitchen"},
+		{Name: "hallway", MQTTClientID: "esp-hallway"},
+		{Name: "office", Profile: "work", Location: &Location{Latitude: 1, Longitude: 2}},
+		{Name: "bedroom", PixelFormat: "2bpp"},
+	}
+	r, err := New(configs, Location{Latitude: 52, Longitude: 10}, "what-to-wear")
+	if err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+
+	if len(r.Variants()) != 3 {
+		t.Fatal("Expected three variants, got ", len(r.Variants()))
+	}
+	if r.devices["bedroom"].Variant.PixelFormat != "2bpp" || r.devices["bedroom"].Variant.ID == DefaultVariantID {
+		t.Error("Devices with another pixel format need their own variant")
+	}
+	if r.devices["kitchen"].Variant.ID != DefaultVariantID {
+		t.Error("Device without settings should use the default variant")
+	}
+	if r.devices["office"].Variant.ID == DefaultVariantID {
+		t.Error("Device with custom settings should not use the default variant")
+	}
+	if r.devices["kitchen"].Config.MQTTTopic != "what-to-wear/devices/kitchen" {
+		t.Error("Unexpected default topic: ", r.devices["kitchen"].Config.MQTTTopic)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	configs := []DeviceConfig{
+		{Name: "kitchen"},
+		{Name: "hallway", MQTTClientID: "esp-hallway"},
+	}
+	r, err := New(configs, Location{}, "what-to-wear")
+	if err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+
+	d, err := r.Identify(url.Values{"device": {"kitchen"}})
+	if err != nil || d == nil || d.Config.Name != "kitchen" {
+		t.Error("Device was not identified by name")
+	}
+	d, err = r.Identify(url.Values{"client_id": {"esp-hallway"}})
+	if err != nil || d == nil || d.Config.Name != "hallway" {
+		t.Error("Device was not identified by client ID")
+	}
+	d, err = r.Identify(url.Values{})
+	if err != nil || d != nil {
+		t.Error("Anonymous requests should not identify a device")
+	}
+	_, err = r.Identify(url.Values{"device": {"garage"}})
+	if err == nil {
+		t.Error("Unknown devices should return an error")
+	}
+}
+
+func TestInvalidDevices(t *testing.T) {
+	_, err := New([]DeviceConfig{{Name: "a"}, {Name: "a"}}, Location{}, "")
+	if err == nil {
+		t.Error("Duplicate names should be rejected")
+	}
+	_, err = New([]DeviceConfig{{Name: "a", PixelFormat: "24bpp"}}, Location{}, "")
+	if err == nil {
+		t.Error("Unsupported pixel formats should be rejected")
+	}
+	_, err = New([]DeviceConfig{{Name: "a", Compression: "gzip"}}, Location{}, "")
+	if err == nil {
+		t.Error("Unknown compressions should be rejected")
+	}
+}
@@ -198,17 +198,36 @@ func Compile(messages *[]Message) error {
 	return nil
 }
 
-func Evaluate(data *owm.WeatherData, messages *[]Message) []string {
+// EvaluationError is returned by Evaluate if one or more messages couldn't be evaluated
+type EvaluationError struct {
+	Errors []error
+}
+
+func (e *EvaluationError) Error() string {
+	if len(e.Errors) == 1 {
+		return "could not evaluate message: " + e.Errors[0].Error()
+	}
+	return fmt.Sprintf("could not evaluate %d messages, first error: %s", len(e.Errors), e.Errors[0])
+}
+
+// Evaluate evaluates all messages. Messages that can't be evaluated result in an
+// empty string and an EvaluationError is returned alongside the remaining messages.
+func Evaluate(data *owm.WeatherData, messages *[]Message) ([]string, error) {
 	processedMessages := []string{}
 	env := buildEnv(data)
+	errs := []error{}
 
 	for i := range *messages {
 		output, err := evaluateMessage(&((*messages)[i]), *env)
 		if err != nil {
 			log.Error("Could not evaluate message: ", err)
+			errs = append(errs, err)
 		}
 		processedMessages = append(processedMessages, output)
 	}
 
-	return processedMessages
+	if len(errs) > 0 {
+		return processedMessages, &EvaluationError{Errors: errs}
+	}
+	return processedMessages, nil
 }
@@ -7,9 +7,10 @@ require (
 	github.com/antonmedv/expr v1.8.9
 	github.com/dschanoeh/go-owm v0.1.2
 	github.com/eclipse/paho.mqtt.golang v1.3.4
+	github.com/prometheus/client_golang v1.11.0
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.8.1
-	golang.org/x/net v0.0.0-20210521195947-fe42d452be8f // indirect
-	golang.org/x/sys v0.0.0-20210521203332-0cec03c779c1 // indirect
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/net v0.0.0-20210521195947-fe42d452be8f
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,122 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// PixelFormatACeP packs 7-color ACeP displays with 4 bits per pixel. Each pixel is
+// the index of its color in ACePPalette.
+const PixelFormatACeP = "acep"
+
+// ACePPalette contains the colors of 7-color ACeP displays in the order of their indices
+var ACePPalette = color.Palette{
+	color.RGBA{A: 255},                         // black
+	color.RGBA{R: 255, G: 255, B: 255, A: 255}, // white
+	color.RGBA{G: 255, A: 255},                 // green
+	color.RGBA{B: 255, A: 255},                 // blue
+	color.RGBA{R: 255, A: 255},                 // red
+	color.RGBA{R: 255, G: 255, A: 255},         // yellow
+	color.RGBA{R: 255, G: 128, A: 255},         // orange
+}
+
+// paletteHex returns the colors of a palette as hex strings like #ff8000
+func paletteHex(p color.Palette) []string {
+	colors := []string{}
+	for _, c := range p {
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		colors = append(colors, fmt.Sprintf("#%02x%02x%02x", rgba.R, rgba.G, rgba.B))
+	}
+	return colors
+}
+
+type lab struct {
+	l, a, b float64
+}
+
+func (c lab) distance(o lab) float64 {
+	dl := c.l - o.l
+	da := c.a - o.a
+	db := c.b - o.b
+	return dl*dl + da*da + db*db
+}
+
+// toLab converts an sRGB color to CIELAB with a D65 white point
+func toLab(c color.Color) lab {
+	rgba := color.RGBAModel.Convert(c).(color.RGBA)
+	linear := func(v uint8) float64 {
+		f := float64(v) / 255
+		if f <= 0.04045 {
+			return f / 12.92
+		}
+		return math.Pow((f+0.055)/1.055, 2.4)
+	}
+	r, g, b := linear(rgba.R), linear(rgba.G), linear(rgba.B)
+
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*b
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return lab{l: 116*fy - 16, a: 500 * (fx - fy), b: 200 * (fy - fz)}
+}
+
+// ditherPalette maps img to the closest colors of the palette in CIELAB space. With dither set,
+// the error is spread to the neighboring pixels with Floyd-Steinberg error diffusion.
+func ditherPalette(img image.Image, palette color.Palette, dither bool) *image.Paletted {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	paletteLab := make([]lab, len(palette))
+	for i, c := range palette {
+		paletteLab[i] = toLab(c)
+	}
+
+	values := make([]lab, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			values[y*width+x] = toLab(img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	spread := func(x int, y int, e lab, weight float64) {
+		if x >= 0 && x < width && y < height {
+			v := &values[y*width+x]
+			v.l += e.l * weight
+			v.a += e.a * weight
+			v.b += e.b * weight
+		}
+	}
+
+	dithered := image.NewPaletted(bounds, palette)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			old := values[y*width+x]
+			best := 0
+			for i, c := range paletteLab {
+				if old.distance(c) < old.distance(paletteLab[best]) {
+					best = i
+				}
+			}
+			dithered.SetColorIndex(bounds.Min.X+x, bounds.Min.Y+y, uint8(best))
+
+			if dither {
+				chosen := paletteLab[best]
+				e := lab{l: old.l - chosen.l, a: old.a - chosen.a, b: old.b - chosen.b}
+				spread(x+1, y, e, 7.0/16)
+				spread(x-1, y+1, e, 3.0/16)
+				spread(x, y+1, e, 5.0/16)
+				spread(x+1, y+1, e, 1.0/16)
+			}
+		}
+	}
+	return dithered
+}
@@ -0,0 +1,56 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestToLab(t *testing.T) {
+	white := toLab(color.White)
+	if math.Abs(white.l-100) > 0.1 || math.Abs(white.a) > 0.1 || math.Abs(white.b) > 0.1 {
+		t.Errorf("Unexpected Lab value for white: %v", white)
+	}
+	black := toLab(color.Black)
+	if black.l != 0 {
+		t.Errorf("Unexpected Lab value for black: %v", black)
+	}
+}
+
+func TestDitherPalette(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, len(ACePPalette), 1))
+	for i, c := range ACePPalette {
+		img.Set(i, 0, c)
+	}
+	for _, dither := range []bool{false, true} {
+		paletted := ditherPalette(img, ACePPalette, dither)
+		for i := range ACePPalette {
+			if paletted.ColorIndexAt(i, 0) != uint8(i) {
+				t.Errorf("Color %d was mapped to %d", i, paletted.ColorIndexAt(i, 0))
+			}
+		}
+	}
+
+	// Colors close to a palette color are mapped to it
+	pink := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	pink.Set(0, 0, color.RGBA{R: 230, G: 40, B: 50, A: 255})
+	if ditherPalette(pink, ACePPalette, false).ColorIndexAt(0, 0) != 4 {
+		t.Error("A reddish color should become red")
+	}
+}
+
+func TestPackIndexed(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 4, 1), ACePPalette)
+	for x, index := range []uint8{0, 1, 6, 4} {
+		img.SetColorIndex(x, 0, index)
+	}
+	data := packIndexed(img, 4, Packing{})
+	if !bytes.Equal(data, []byte{0x01, 0x64}) {
+		t.Errorf("Unexpected packed data %x", data)
+	}
+	if paletteHex(ACePPalette)[6] != "#ff8000" {
+		t.Error("Unexpected hex color for orange: ", paletteHex(ACePPalette)[6])
+	}
+}
@@ -0,0 +1,624 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	cdpLaunchTimeout   = 10 * time.Second
+	cdpCloseTimeout    = time.Second
+	cdpNetworkIdleTime = 500 * time.Millisecond
+	cdpPollInterval    = 50 * time.Millisecond
+	cdpOrigin          = "http://127.0.0.1"
+)
+
+var devToolsURLPattern = regexp.MustCompile(`DevTools listening on (ws://\S+)`)
+
+var errBrowserClosed = errors.New("connection to Chrome lost")
+
+type cdpRequest struct {
+	ID        int64       `json:"id"`
+	Method    string      `json:"method"`
+	Params    interface{} `json:"params,omitempty"`
+	SessionID string      `json:"sessionId,omitempty"`
+}
+
+// cdpMessage is either the response to a request (ID is set) or an event
+type cdpMessage struct {
+	ID        int64           `json:"id,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *cdpError       `json:"error,omitempty"`
+}
+
+type cdpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *cdpError) Error() string {
+	return fmt.Sprintf("CDP error %d: %s", e.Code, e.Message)
+}
+
+// cdpBrowser is a headless Chrome instance controlled through the DevTools protocol.
+// It is shared by all renderers using the same binary and started on demand, so a
+// crashed browser is replaced on the next render.
+type cdpBrowser struct {
+	binary string
+	users  int
+
+	mutex       sync.Mutex
+	cmd         *exec.Cmd
+	userDataDir string
+	ws          *websocket.Conn
+	done        chan struct{}
+	generation  int
+	lastID      int64
+	pending     map[int64]chan *cdpMessage
+	handlers    map[string]func(*cdpMessage)
+}
+
+var (
+	browsersMutex sync.Mutex
+	browsers      = map[string]*cdpBrowser{}
+)
+
+func acquireBrowser(binary string) *cdpBrowser {
+	browsersMutex.Lock()
+	defer browsersMutex.Unlock()
+	b, ok := browsers[binary]
+	if !ok {
+		b = &cdpBrowser{binary: binary}
+		browsers[binary] = b
+	}
+	b.users++
+	return b
+}
+
+// releaseBrowser stops the browser once its last user is gone
+func releaseBrowser(b *cdpBrowser) {
+	browsersMutex.Lock()
+	defer browsersMutex.Unlock()
+	b.users--
+	if b.users > 0 {
+		return
+	}
+	delete(browsers, b.binary)
+	b.mutex.Lock()
+	b.stop()
+	b.mutex.Unlock()
+}
+
+// start launches the browser unless it is already running and returns its generation,
+// which changes whenever a new browser was started.
+func (b *cdpBrowser) start() (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.done != nil {
+		select {
+		case <-b.done:
+			log.Warn("Chrome connection was lost, restarting")
+		default:
+			return b.generation, nil
+		}
+	}
+	b.stop()
+
+	userDataDir, err := ioutil.TempDir("", "what-to-wear-chrome")
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(b.binary,
+		"--headless",
+		"--disable-gpu",
+		"--disable-extensions",
+		"--disable-dev-shm-usage",
+		// Pages rendered from memory load fonts from disk
+		"--allow-file-access-from-files",
+		"--hide-scrollbars",
+		"--remote-debugging-port=0",
+		"--remote-allow-origins="+cdpOrigin,
+		"--user-data-dir="+userDataDir,
+		"about:blank",
+	)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		os.RemoveAll(userDataDir)
+		return 0, err
+	}
+	log.Debug("Starting chrome...")
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(userDataDir)
+		return 0, err
+	}
+	b.cmd = cmd
+	b.userDataDir = userDataDir
+
+	url, err := readDevToolsURL(stderr)
+	if err != nil {
+		b.stop()
+		return 0, err
+	}
+	if err := b.connect(url); err != nil {
+		b.stop()
+		return 0, err
+	}
+	return b.generation, nil
+}
+
+// readDevToolsURL waits for Chrome to announce its DevTools endpoint. The rest
+// of the output is logged so the pipe doesn't fill up.
+func readDevToolsURL(stderr io.Reader) (string, error) {
+	urls := make(chan string, 1)
+	go func() {
+		found := false
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Debug("Chrome: ", scanner.Text())
+			if m := devToolsURLPattern.FindStringSubmatch(scanner.Text()); m != nil && !found {
+				found = true
+				urls <- m[1]
+			}
+		}
+		if !found {
+			close(urls)
+		}
+	}()
+
+	select {
+	case url, ok := <-urls:
+		if !ok {
+			return "", errors.New("Chrome exited before the DevTools endpoint was available")
+		}
+		return url, nil
+	case <-time.After(cdpLaunchTimeout):
+		return "", errors.New("Chrome timeout")
+	}
+}
+
+// connect opens the DevTools connection. The mutex has to be held.
+func (b *cdpBrowser) connect(url string) error {
+	ws, err := websocket.Dial(url, "", cdpOrigin)
+	if err != nil {
+		return err
+	}
+	b.ws = ws
+	b.done = make(chan struct{})
+	b.pending = map[int64]chan *cdpMessage{}
+	b.handlers = map[string]func(*cdpMessage){}
+	b.generation++
+	go b.read(ws, b.done)
+	return nil
+}
+
+// stop closes the connection and kills the browser. The mutex has to be held.
+func (b *cdpBrowser) stop() {
+	if b.ws != nil {
+		b.ws.Close()
+		b.ws = nil
+	}
+	if b.cmd != nil {
+		b.cmd.Process.Kill()
+		b.cmd.Wait()
+		b.cmd = nil
+	}
+	if b.userDataDir != "" {
+		os.RemoveAll(b.userDataDir)
+		b.userDataDir = ""
+	}
+}
+
+func (b *cdpBrowser) read(ws *websocket.Conn, done chan struct{}) {
+	defer close(done)
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			log.Debug("Chrome connection closed: ", err)
+			return
+		}
+		var msg cdpMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Warn("Invalid message from Chrome: ", err)
+			continue
+		}
+
+		b.mutex.Lock()
+		if msg.ID != 0 {
+			ch := b.pending[msg.ID]
+			delete(b.pending, msg.ID)
+			b.mutex.Unlock()
+			if ch != nil {
+				ch <- &msg
+			}
+		} else {
+			handler := b.handlers[msg.SessionID]
+			b.mutex.Unlock()
+			if handler != nil {
+				handler(&msg)
+			}
+		}
+	}
+}
+
+// setHandler registers a function receiving the events of a session. Handlers
+// are called from the connection's read loop and must not block.
+func (b *cdpBrowser) setHandler(sessionID string, handler func(*cdpMessage)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if handler == nil {
+		delete(b.handlers, sessionID)
+	} else if b.handlers != nil {
+		b.handlers[sessionID] = handler
+	}
+}
+
+// call sends a command and waits for its response, which is decoded into result if it isn't nil.
+func (b *cdpBrowser) call(ctx context.Context, sessionID string, method string, params interface{}, result interface{}) error {
+	b.mutex.Lock()
+	if b.ws == nil {
+		b.mutex.Unlock()
+		return errBrowserClosed
+	}
+	b.lastID++
+	id := b.lastID
+	response := make(chan *cdpMessage, 1)
+	b.pending[id] = response
+	ws, done := b.ws, b.done
+	b.mutex.Unlock()
+
+	removePending := func() {
+		b.mutex.Lock()
+		delete(b.pending, id)
+		b.mutex.Unlock()
+	}
+
+	data, err := json.Marshal(cdpRequest{ID: id, Method: method, Params: params, SessionID: sessionID})
+	if err != nil {
+		removePending()
+		return err
+	}
+	if err := websocket.Message.Send(ws, string(data)); err != nil {
+		removePending()
+		return err
+	}
+
+	select {
+	case msg := <-response:
+		if msg.Error != nil {
+			return fmt.Errorf("%s: %w", method, msg.Error)
+		}
+		if result != nil {
+			return json.Unmarshal(msg.Result, result)
+		}
+		return nil
+	case <-done:
+		return errBrowserClosed
+	case <-ctx.Done():
+		removePending()
+		return fmt.Errorf("%s: %w", method, ctx.Err())
+	}
+}
+
+// pageState tracks the loading state of a page based on its events
+type pageState struct {
+	mutex        sync.Mutex
+	loaded       bool
+	requests     map[string]bool
+	lastActivity time.Time
+}
+
+func newPageState() *pageState {
+	return &pageState{requests: map[string]bool{}}
+}
+
+func (p *pageState) handle(msg *cdpMessage) {
+	var params struct {
+		RequestID string `json:"requestId"`
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch msg.Method {
+	case "Page.loadEventFired":
+		p.loaded = true
+	case "Network.requestWillBeSent":
+		if json.Unmarshal(msg.Params, &params) == nil {
+			p.requests[params.RequestID] = true
+		}
+	case "Network.loadingFinished", "Network.loadingFailed":
+		if json.Unmarshal(msg.Params, &params) == nil {
+			delete(p.requests, params.RequestID)
+		}
+	default:
+		return
+	}
+	p.lastActivity = time.Now()
+}
+
+func (p *pageState) reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.loaded = false
+	p.requests = map[string]bool{}
+	p.lastActivity = time.Now()
+}
+
+func (p *pageState) setLoaded() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.loaded = true
+	p.lastActivity = time.Now()
+}
+
+// idle returns true once the page is loaded and no requests were made for cdpNetworkIdleTime
+func (p *pageState) idle() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.loaded && len(p.requests) == 0 && time.Since(p.lastActivity) >= cdpNetworkIdleTime
+}
+
+// cdpRenderer renders ScrapeURL, or the HTML of the document if it isn't set, in a
+// page of a persistent browser and captures it to memory.
+type cdpRenderer struct {
+	imageConfig *ImageConfig
+	browser     *cdpBrowser
+	generation  int
+	targetID    string
+	sessionID   string
+	page        *pageState
+}
+
+func newCDPRenderer(config *ImageConfig) (*cdpRenderer, error) {
+	_, err := exec.LookPath(config.ChromeBinary)
+	if err != nil {
+		return nil, errors.New("didn't find Chrome executable " + config.ChromeBinary)
+	}
+	return &cdpRenderer{imageConfig: config, browser: acquireBrowser(config.ChromeBinary)}, nil
+}
+
+func (r *cdpRenderer) Render(ctx context.Context, doc *Document) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(ctx, chromeTimeout*time.Millisecond)
+	defer cancel()
+
+	img, err := r.render(ctx, doc)
+	if err != nil {
+		// Start over with a fresh page on the next attempt
+		r.closePage()
+	}
+	return img, err
+}
+
+func (r *cdpRenderer) render(ctx context.Context, doc *Document) (image.Image, error) {
+	if err := r.openPage(ctx); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if r.imageConfig.ScrapeURL != "" {
+		err = r.navigate(ctx, r.imageConfig.ScrapeURL)
+	} else if doc != nil && doc.HTML != "" {
+		err = r.loadHTML(ctx, doc)
+	} else {
+		err = errors.New("neither a scrape URL nor HTML to render")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.waitForNetworkIdle(ctx); err != nil {
+		return nil, err
+	}
+	if err := r.evaluate(ctx, "document.fonts.ready.then(() => true)"); err != nil {
+		return nil, err
+	}
+
+	return r.capture(ctx)
+}
+
+// openPage creates the page used for rendering unless it already exists in the running browser
+func (r *cdpRenderer) openPage(ctx context.Context) error {
+	generation, err := r.browser.start()
+	if err != nil {
+		return err
+	}
+	if r.sessionID != "" && generation == r.generation {
+		return nil
+	}
+	r.generation = generation
+
+	var target struct {
+		TargetID string `json:"targetId"`
+	}
+	err = r.browser.call(ctx, "", "Target.createTarget", map[string]interface{}{"url": "about:blank"}, &target)
+	if err != nil {
+		return err
+	}
+	var session struct {
+		SessionID string `json:"sessionId"`
+	}
+	err = r.browser.call(ctx, "", "Target.attachToTarget", map[string]interface{}{"targetId": target.TargetID, "flatten": true}, &session)
+	if err != nil {
+		return err
+	}
+	r.targetID = target.TargetID
+	r.sessionID = session.SessionID
+	r.page = newPageState()
+	r.browser.setHandler(r.sessionID, r.page.handle)
+
+	for _, method := range []string{"Page.enable", "Network.enable"} {
+		if err := r.browser.call(ctx, r.sessionID, method, nil, nil); err != nil {
+			return err
+		}
+	}
+	return r.browser.call(ctx, r.sessionID, "Emulation.setDeviceMetricsOverride", map[string]interface{}{
+		"width":             r.imageConfig.Width,
+		"height":            r.imageConfig.Height,
+		"deviceScaleFactor": 1,
+		"mobile":            false,
+	}, nil)
+}
+
+func (r *cdpRenderer) closePage() {
+	if r.sessionID == "" {
+		return
+	}
+	r.browser.setHandler(r.sessionID, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), cdpCloseTimeout)
+	defer cancel()
+	r.browser.call(ctx, "", "Target.closeTarget", map[string]interface{}{"targetId": r.targetID}, nil)
+	r.targetID = ""
+	r.sessionID = ""
+}
+
+func (r *cdpRenderer) navigate(ctx context.Context, url string) error {
+	r.page.reset()
+	var result struct {
+		ErrorText string `json:"errorText"`
+	}
+	err := r.browser.call(ctx, r.sessionID, "Page.navigate", map[string]interface{}{"url": url}, &result)
+	if err != nil {
+		return err
+	}
+	if result.ErrorText != "" {
+		return fmt.Errorf("navigating to %s failed: %s", url, result.ErrorText)
+	}
+	return nil
+}
+
+// loadHTML replaces the content of the page with the HTML of the document without writing
+// it to disk. The page is navigated to the document's AssetDir first, so the document has
+// a file:// origin that is allowed to load the assets.
+func (r *cdpRenderer) loadHTML(ctx context.Context, doc *Document) error {
+	page, err := pageHTML(doc)
+	if err != nil {
+		return err
+	}
+	assetDir, err := filepath.Abs(doc.AssetDir)
+	if err != nil {
+		return err
+	}
+	if err := r.navigate(ctx, fileURL(assetDir)+"/"); err != nil {
+		return err
+	}
+
+	var tree struct {
+		FrameTree struct {
+			Frame struct {
+				ID string `json:"id"`
+			} `json:"frame"`
+		} `json:"frameTree"`
+	}
+	if err := r.browser.call(ctx, r.sessionID, "Page.getFrameTree", nil, &tree); err != nil {
+		return err
+	}
+	r.page.reset()
+	err = r.browser.call(ctx, r.sessionID, "Page.setDocumentContent", map[string]interface{}{
+		"frameId": tree.FrameTree.Frame.ID,
+		"html":    page,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	// setDocumentContent doesn't fire a load event
+	err = r.evaluate(ctx, `new Promise(resolve => {
+		if (document.readyState === "complete") {
+			resolve(true);
+		} else {
+			window.addEventListener("load", () => resolve(true));
+		}
+	})`)
+	if err != nil {
+		return err
+	}
+	r.page.setLoaded()
+	return nil
+}
+
+func (r *cdpRenderer) waitForNetworkIdle(ctx context.Context) error {
+	ticker := time.NewTicker(cdpPollInterval)
+	defer ticker.Stop()
+	for {
+		if r.page.idle() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for the page to load: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// evaluate runs a JavaScript expression and waits for the promise it returns
+func (r *cdpRenderer) evaluate(ctx context.Context, expression string) error {
+	var result struct {
+		ExceptionDetails *struct {
+			Text string `json:"text"`
+		} `json:"exceptionDetails"`
+	}
+	err := r.browser.call(ctx, r.sessionID, "Runtime.evaluate", map[string]interface{}{
+		"expression":    expression,
+		"awaitPromise":  true,
+		"returnByValue": true,
+	}, &result)
+	if err != nil {
+		return err
+	}
+	if result.ExceptionDetails != nil {
+		return errors.New("JavaScript exception: " + result.ExceptionDetails.Text)
+	}
+	return nil
+}
+
+func (r *cdpRenderer) capture(ctx context.Context) (image.Image, error) {
+	var screenshot struct {
+		Data string `json:"data"`
+	}
+	err := r.browser.call(ctx, r.sessionID, "Page.captureScreenshot", map[string]interface{}{
+		"format": "png",
+		"clip": map[string]interface{}{
+			"x":      0,
+			"y":      0,
+			"width":  r.imageConfig.Width,
+			"height": r.imageConfig.Height,
+			"scale":  1,
+		},
+	}, &screenshot)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(screenshot.Data)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(data))
+}
+
+// Close closes the page and stops the browser if no other renderer uses it
+func (r *cdpRenderer) Close() error {
+	r.closePage()
+	releaseBrowser(r.browser)
+	return nil
+}
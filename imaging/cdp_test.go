@@ -0,0 +1,126 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// fakeBrowser answers DevTools commands like Chrome would for a page without errors
+type fakeBrowser struct {
+	mutex sync.Mutex
+	urls  []string
+	html  string
+}
+
+func (f *fakeBrowser) handle(ws *websocket.Conn) {
+	var screenshot bytes.Buffer
+	png.Encode(&screenshot, testImage())
+
+	for {
+		var request cdpMessage
+		if err := websocket.JSON.Receive(ws, &request); err != nil {
+			return
+		}
+		var params struct {
+			URL  string `json:"url"`
+			HTML string `json:"html"`
+		}
+		json.Unmarshal(request.Params, &params)
+		f.mutex.Lock()
+		if request.Method == "Page.navigate" {
+			f.urls = append(f.urls, params.URL)
+		}
+		if request.Method == "Page.setDocumentContent" {
+			f.html = params.HTML
+		}
+		f.mutex.Unlock()
+
+		result := map[string]interface{}{}
+		var events []string
+		switch request.Method {
+		case "Target.createTarget":
+			result["targetId"] = "target"
+		case "Target.attachToTarget":
+			result["sessionId"] = "session"
+		case "Page.navigate":
+			events = []string{"Network.requestWillBeSent", "Network.loadingFinished", "Page.loadEventFired"}
+		case "Page.getFrameTree":
+			result["frameTree"] = map[string]interface{}{"frame": map[string]string{"id": "frame"}}
+		case "Page.captureScreenshot":
+			result["data"] = base64.StdEncoding.EncodeToString(screenshot.Bytes())
+		}
+		data, _ := json.Marshal(result)
+		websocket.JSON.Send(ws, cdpMessage{ID: request.ID, Result: data})
+		for _, e := range events {
+			websocket.JSON.Send(ws, cdpMessage{Method: e, SessionID: "session", Params: json.RawMessage(`{"requestId":"1"}`)})
+		}
+	}
+}
+
+func (f *fakeBrowser) lastURL() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.urls) == 0 {
+		return ""
+	}
+	return f.urls[len(f.urls)-1]
+}
+
+func TestCDPRender(t *testing.T) {
+	fake := &fakeBrowser{}
+	server := httptest.NewServer(websocket.Handler(fake.handle))
+	defer server.Close()
+
+	b := &cdpBrowser{binary: "chrome"}
+	b.mutex.Lock()
+	err := b.connect("ws://" + strings.TrimPrefix(server.URL, "http://"))
+	b.mutex.Unlock()
+	if err != nil {
+		t.Fatal("Could not connect: ", err)
+	}
+	defer func() {
+		b.mutex.Lock()
+		b.stop()
+		b.mutex.Unlock()
+	}()
+
+	config := &ImageConfig{Width: 10, Height: 3, ScrapeURL: "http://127.0.0.1:7000"}
+	r := &cdpRenderer{imageConfig: config, browser: b}
+	img, err := r.Render(context.Background(), &Document{HTML: "<p>Hey there.</p>"})
+	if err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+	if img.Bounds().Dx() != 10 || img.Bounds().Dy() != 3 {
+		t.Errorf("Unexpected image size %v", img.Bounds())
+	}
+	if fake.lastURL() != config.ScrapeURL {
+		t.Errorf("The scrape URL should have been rendered instead of %s", fake.lastURL())
+	}
+
+	config.ScrapeURL = ""
+	_, err = r.Render(context.Background(), &Document{HTML: "<p>Hey there.</p>"})
+	if err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+	if !strings.HasPrefix(fake.lastURL(), "file://") {
+		t.Errorf("The asset directory should have been opened instead of %s", fake.lastURL())
+	}
+	fake.mutex.Lock()
+	html := fake.html
+	fake.mutex.Unlock()
+	if !strings.Contains(html, "<base") || !strings.Contains(html, "Hey there.") {
+		t.Errorf("The HTML should have been loaded into the page, got %q", html)
+	}
+	if r.sessionID != "session" {
+		t.Error("The page should have been kept open")
+	}
+}
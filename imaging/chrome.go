@@ -0,0 +1,82 @@
+package imaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/MaxHalford/halfgone"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	chromeScreenshotFilename = "screenshot.png"
+	chromeTimeout            = 10000 // in ms
+	VirtualTimeBudget        = 5000  // in ms
+)
+
+// chromeRenderer takes a screenshot of the page with a headless Chrome instance
+type chromeRenderer struct {
+	imageConfig *ImageConfig
+	tempDir     string
+}
+
+func (r *chromeRenderer) Render(ctx context.Context, doc *Document) (image.Image, error) {
+	url, err := pageURL(r.imageConfig, r.tempDir, doc)
+	if err != nil {
+		return nil, err
+	}
+	err = r.takeScreenshot(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return halfgone.LoadImage(r.tempDir + "/" + chromeScreenshotFilename)
+}
+
+func (r *chromeRenderer) takeScreenshot(ctx context.Context, url string) error {
+	_, err := exec.LookPath(r.imageConfig.ChromeBinary)
+	if err != nil {
+		return errors.New("didn't find Chrome executable" + r.imageConfig.ChromeBinary)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, chromeTimeout*time.Millisecond)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, r.imageConfig.ChromeBinary,
+		"--headless",
+		"--disable-gpu",
+		"--disable-extensions",
+		"--disable-dev-shm-usage",
+		// Pages rendered from memory load fonts from disk
+		"--allow-file-access-from-files",
+		"--screenshot",
+		fmt.Sprintf("--window-size=%d,%d", r.imageConfig.Width, r.imageConfig.Height),
+		fmt.Sprintf("--virtual-time-budget=%d", VirtualTimeBudget),
+		url,
+	)
+
+	cmd.Dir = r.tempDir + "/"
+	log.Debug("Starting chrome...")
+	out, err := cmd.Output()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Error("Chrome output: ", string(out))
+		return errors.New("Chrome timeout")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Chrome is done.")
+
+	if _, err := os.Stat(r.tempDir + "/" + chromeScreenshotFilename); err == nil {
+		return nil
+	}
+
+	return errors.New("Screenshot was not created")
+}
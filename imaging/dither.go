@@ -0,0 +1,115 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/MaxHalford/halfgone"
+)
+
+// Available dithering algorithms
+const (
+	DitheringSierra         = "sierra"
+	DitheringFloydSteinberg = "floyd-steinberg"
+	DitheringAtkinson       = "atkinson"
+	DitheringBayer          = "bayer"
+	DitheringThreshold      = "threshold"
+	DitheringOtsu           = "otsu"
+)
+
+const defaultThreshold = 127
+
+// DitheringAlgorithms lists all algorithms that can be configured
+var DitheringAlgorithms = []string{
+	DitheringSierra,
+	DitheringFloydSteinberg,
+	DitheringAtkinson,
+	DitheringBayer,
+	DitheringThreshold,
+	DitheringOtsu,
+}
+
+func newDitherer(config *ImageConfig) (halfgone.Ditherer, error) {
+	switch config.DitheringAlgorithm {
+	case "", DitheringSierra:
+		return halfgone.TwoRowSierraDitherer{}, nil
+	case DitheringFloydSteinberg:
+		return halfgone.FloydSteinbergDitherer{}, nil
+	case DitheringAtkinson:
+		return halfgone.AtkinsonDitherer{}, nil
+	case DitheringBayer:
+		return halfgone.Order8OrderedDitherer{}, nil
+	case DitheringThreshold:
+		return halfgone.ThresholdDitherer{Threshold: configuredThreshold(config)}, nil
+	case DitheringOtsu:
+		return otsuDitherer{}, nil
+	}
+	return nil, fmt.Errorf("unknown dithering algorithm %s", config.DitheringAlgorithm)
+}
+
+func configuredThreshold(config *ImageConfig) uint8 {
+	if config.Threshold == 0 {
+		return defaultThreshold
+	}
+	return config.Threshold
+}
+
+// thresholdImage converts gray to black and white if dithering is disabled. Pixels brighter
+// than the configured threshold, or Otsu's threshold for DitheringOtsu, become white.
+func thresholdImage(config *ImageConfig, gray *image.Gray) *image.Gray {
+	if config.DitheringAlgorithm == DitheringOtsu {
+		return otsuDitherer{}.Apply(gray)
+	}
+	return halfgone.ThresholdDitherer{Threshold: configuredThreshold(config)}.Apply(gray)
+}
+
+// otsuDitherer applies a threshold that is chosen for each image with Otsu's method
+type otsuDitherer struct{}
+
+func (otsuDitherer) Apply(gray *image.Gray) *image.Gray {
+	return halfgone.ThresholdDitherer{Threshold: otsuThreshold(gray)}.Apply(gray)
+}
+
+// otsuThreshold returns the threshold that maximizes the variance between the
+// pixels at or below it and the ones above it.
+func otsuThreshold(gray *image.Gray) uint8 {
+	var histogram [256]int
+	bounds := gray.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			histogram[gray.GrayAt(x, y).Y]++
+		}
+	}
+
+	total := bounds.Dx() * bounds.Dy()
+	sum := 0.0
+	for i, n := range histogram {
+		sum += float64(i * n)
+	}
+
+	var (
+		best        uint8
+		maxVariance float64
+		sumBelow    float64
+		countBelow  int
+	)
+	for t := 0; t < 256; t++ {
+		countBelow += histogram[t]
+		if countBelow == 0 {
+			continue
+		}
+		countAbove := total - countBelow
+		if countAbove == 0 {
+			break
+		}
+		sumBelow += float64(t * histogram[t])
+		meanBelow := sumBelow / float64(countBelow)
+		meanAbove := (sum - sumBelow) / float64(countAbove)
+		variance := float64(countBelow) * float64(countAbove) * (meanBelow - meanAbove) * (meanBelow - meanAbove)
+		if variance > maxVariance {
+			maxVariance = variance
+			best = uint8(t)
+		}
+	}
+	return best
+}
@@ -0,0 +1,107 @@
+package imaging
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/MaxHalford/halfgone"
+)
+
+var update = flag.Bool("update", false, "update the golden images in testdata")
+
+// TestDitheringGolden compares the output of each algorithm with the images in testdata.
+// Run with -update after changing an algorithm and review the new images.
+func TestDitheringGolden(t *testing.T) {
+	input, err := halfgone.LoadImage("testdata/dither-input.png")
+	if err != nil {
+		t.Fatal("Could not load input: ", err)
+	}
+	gray := halfgone.ImageToGray(input)
+
+	for _, algorithm := range DitheringAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			ditherer, err := newDitherer(&ImageConfig{DitheringAlgorithm: algorithm})
+			if err != nil {
+				t.Fatal("Could not create ditherer: ", err)
+			}
+			dithered := ditherer.Apply(gray)
+
+			golden := "testdata/dither-" + algorithm + ".png"
+			if *update {
+				if err := halfgone.SaveImagePNG(dithered, golden); err != nil {
+					t.Fatal("Could not save golden image: ", err)
+				}
+				return
+			}
+			expected, err := halfgone.LoadImage(golden)
+			if err != nil {
+				t.Fatal("Could not load golden image: ", err)
+			}
+			expectedGray := halfgone.ImageToGray(expected)
+			if !expectedGray.Bounds().Eq(dithered.Bounds()) {
+				t.Fatalf("Expected size %v but got %v", expectedGray.Bounds(), dithered.Bounds())
+			}
+			bounds := dithered.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					if px := dithered.GrayAt(x, y); px.Y != 0 && px.Y != 255 {
+						t.Fatalf("Pixel (%d, %d) isn't black or white: %d", x, y, px.Y)
+					}
+					if dithered.GrayAt(x, y) != expectedGray.GrayAt(x, y) {
+						t.Fatalf("Pixel (%d, %d) differs from %s", x, y, golden)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOtsuThreshold(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			if x < 3 {
+				img.SetGray(x, y, color.Gray{Y: 60})
+			} else {
+				img.SetGray(x, y, color.Gray{Y: 200})
+			}
+		}
+	}
+	threshold := otsuThreshold(img)
+	if threshold < 60 || threshold >= 200 {
+		t.Errorf("Threshold %d doesn't separate the two classes", threshold)
+	}
+}
+
+func TestUnknownDitheringAlgorithm(t *testing.T) {
+	if _, err := newDitherer(&ImageConfig{DitheringAlgorithm: "random"}); err == nil {
+		t.Error("An error should have been returned")
+	}
+}
+
+func TestThresholdWithoutDithering(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 3, 1))
+	for x, y := range []uint8{1, 100, 150} {
+		img.SetGray(x, 0, color.Gray{Y: y})
+	}
+
+	tests := []struct {
+		config   ImageConfig
+		expected []uint8
+	}{
+		{ImageConfig{}, []uint8{0, 0, 255}},
+		{ImageConfig{Threshold: 50}, []uint8{0, 255, 255}},
+		{ImageConfig{Threshold: 200}, []uint8{0, 0, 0}},
+		{ImageConfig{DitheringAlgorithm: DitheringOtsu}, []uint8{0, 255, 255}},
+	}
+	for _, test := range tests {
+		result := thresholdImage(&test.config, img)
+		for x, expected := range test.expected {
+			if result.GrayAt(x, 0).Y != expected {
+				t.Errorf("%+v: pixel %d is %d instead of %d", test.config, x, result.GrayAt(x, 0).Y, expected)
+			}
+		}
+	}
+}
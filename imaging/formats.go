@@ -0,0 +1,101 @@
+package imaging
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+)
+
+// EncodePNG writes the image as grayscale PNG.
+func EncodePNG(w io.Writer, img *image.Gray) error {
+	return png.Encode(w, img)
+}
+
+// EncodeBMP writes the image as uncompressed 8 bit BMP with a grayscale palette.
+func EncodeBMP(w io.Writer, img *image.Gray) error {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	const fileHeaderSize = 14
+	const infoHeaderSize = 40
+	const paletteSize = 256 * 4
+	// Rows are padded to multiples of 4 bytes
+	stride := (width + 3) &^ 3
+	offset := fileHeaderSize + infoHeaderSize + paletteSize
+	size := offset + stride*height
+
+	header := []interface{}{
+		// File header
+		[2]byte{'B', 'M'},
+		uint32(size),
+		uint32(0), // reserved
+		uint32(offset),
+		// BITMAPINFOHEADER
+		uint32(infoHeaderSize),
+		int32(width),
+		int32(height), // positive height means bottom-up rows
+		uint16(1),     // planes
+		uint16(8),     // bits per pixel
+		uint32(0),     // no compression
+		uint32(stride * height),
+		int32(2835), // 72 DPI
+		int32(2835),
+		uint32(256), // colors in palette
+		uint32(0),
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, v := range header {
+		if err := binary.Write(bw, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	for c := 0; c < 256; c++ {
+		bw.Write([]byte{byte(c), byte(c), byte(c), 0})
+	}
+
+	row := make([]byte, stride)
+	for y := height - 1; y >= 0; y-- {
+		for x := 0; x < width; x++ {
+			row[x] = img.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// EncodePBM writes the image as binary (P4) portable bitmap. Like GetImageAsBinary,
+// every pixel that isn't fully black is considered white.
+func EncodePBM(w io.Writer, img *image.Gray) error {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P4\n%d %d\n", width, height)
+
+	// Each row is padded to full bytes, 1 represents black
+	row := make([]byte, (width+7)/8)
+	for y := 0; y < height; y++ {
+		for i := range row {
+			row[i] = 0
+		}
+		for x := 0; x < width; x++ {
+			if img.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y == 0 {
+				row[x/8] |= 1 << (7 - uint(x%8))
+			}
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
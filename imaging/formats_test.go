@@ -0,0 +1,73 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func testImage() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 10, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 10; x++ {
+			if (x+y)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestEncodePNG(t *testing.T) {
+	img := testImage()
+	var buf bytes.Buffer
+	if err := EncodePNG(&buf, img); err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+	decoded, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal("Could not decode PNG: ", err)
+	}
+	if !bytes.Equal(decoded.(*image.Gray).Pix, img.Pix) {
+		t.Error("Decoded PNG differs from the source image")
+	}
+}
+
+func TestEncodePBM(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodePBM(&buf, testImage()); err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+	expected := append([]byte("P4\n10 3\n"),
+		0x55, 0x40, // 0101010101 padded
+		0xaa, 0x80,
+		0x55, 0x40,
+	)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Unexpected PBM: %x", buf.Bytes())
+	}
+}
+
+func TestEncodeBMP(t *testing.T) {
+	img := testImage()
+	var buf bytes.Buffer
+	if err := EncodeBMP(&buf, img); err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+	data := buf.Bytes()
+	// 14 + 40 header bytes, 1024 palette bytes, 3 rows padded to 12 bytes
+	if len(data) != 14+40+1024+3*12 {
+		t.Fatal("Unexpected BMP size: ", len(data))
+	}
+	if string(data[0:2]) != "BM" || binary.LittleEndian.Uint32(data[2:6]) != uint32(len(data)) {
+		t.Error("Invalid BMP file header")
+	}
+	offset := binary.LittleEndian.Uint32(data[10:14])
+	// The first row stored is the bottom one
+	if data[offset] != 255 || data[offset+1] != 0 {
+		t.Error("Unexpected pixel data")
+	}
+}
@@ -5,36 +5,85 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"time"
 
 	"github.com/MaxHalford/halfgone"
+	"github.com/dschanoeh/what-to-wear/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	chromeScreenshotFilename = "screenshot.png"
-	ditheredFilename         = "dithered.png"
-	chromeTimeout            = 10000 // in ms
-	VirtualTimeBudget        = 5000  // in ms
-	screenshotRetries        = 3
+	ditheredFilename  = "dithered.png"
+	screenshotRetries = 3
+)
+
+// Available renderers
+const (
+	RendererChrome = "chrome"
+	RendererNative = "native"
+	RendererCDP    = "cdp"
 )
 
 type ImageConfig struct {
 	Width        int    `yaml:"width"`
 	Height       int    `yaml:"height"`
+	Renderer     string `yaml:"renderer"`
 	ChromeBinary string `yaml:"chrome_binary"`
 	ScrapeURL    string `yaml:"scrape_url"`
+	FontFile     string `yaml:"font_file"`
 	WorkingDir   string `yaml:"working_dir"`
 	Dithering    bool   `yaml:"dithering"`
+	// DitheringAlgorithm is one of DitheringAlgorithms, the default is DitheringSierra
+	DitheringAlgorithm string `yaml:"dithering_algorithm"`
+	// Threshold for DitheringThreshold, pixels brighter than it become white. 0 uses the default of 127.
+	Threshold uint8 `yaml:"threshold"`
+	// Palette is PaletteBlackWhite (default) or one of the tri-color palettes
+	Palette string `yaml:"palette"`
+	// PixelFormat of the packed display buffer. It is set per variant from the device configuration.
+	PixelFormat string `yaml:"-"`
+	// Packing describes how the display buffer is laid out
+	Packing Packing `yaml:"packing"`
+	// PartialRefresh publishes the changed regions in addition to the complete image
+	PartialRefresh PartialRefreshConfig `yaml:"partial_refresh"`
+}
+
+// Document describes what is shown on the display. Messages may contain HTML.
+type Document struct {
+	Greeting string
+	Icon     string
+	Report   string
+	Messages []string
+	Footer   []string
+	// HTML of the page and the directory its assets are located in. Browser
+	// based renderers render it unless ScrapeURL is set.
+	HTML     string
+	AssetDir string
+}
+
+// Renderer creates an image of a document
+type Renderer interface {
+	Render(ctx context.Context, doc *Document) (image.Image, error)
 }
 
 type ImageProcessor struct {
-	imageConfig  *ImageConfig
-	currentImage *image.Gray
-	tempDir      string
+	imageConfig   *ImageConfig
+	renderer      Renderer
+	ditherer      halfgone.Ditherer
+	accentColor   *color.RGBA
+	bitsPerPixel  int
+	currentImage  *image.Gray
+	currentAccent *image.Gray
+	currentColor  *image.Paletted
+	tempDir       string
+	// Packed planes of the previous image and the number of partial refreshes since the last full one
+	previousData     []byte
+	previousAccent   []byte
+	partialRefreshes int
+	refresh          *Refresh
 }
 
 func New(config *ImageConfig) (*ImageProcessor, error) {
@@ -46,91 +95,115 @@ func New(config *ImageConfig) (*ImageProcessor, error) {
 
 	i := ImageProcessor{imageConfig: config, tempDir: tempDir}
 
-	return &i, nil
-}
-func (i *ImageProcessor) Close() error {
-	err := os.RemoveAll(i.tempDir)
+	i.ditherer, err = newDitherer(config)
 	if err != nil {
-		log.Error("Couldn't delete temp dir:", err)
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+	i.bitsPerPixel, err = BitsPerPixel(config.PixelFormat)
+	if err == nil {
+		err = config.Packing.validate(config.PixelFormat)
 	}
-
-	return err
-}
-
-func (i *ImageProcessor) takeScreenshot() error {
-	_, err := exec.LookPath(i.imageConfig.ChromeBinary)
 	if err != nil {
-		return errors.New("didn't find Chrome executable" + i.imageConfig.ChromeBinary)
+		os.RemoveAll(tempDir)
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), chromeTimeout*time.Millisecond)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, i.imageConfig.ChromeBinary,
-		"--headless",
-		"--disable-gpu",
-		"--disable-extensions",
-		"--disable-dev-shm-usage",
-		"--screenshot",
-		fmt.Sprintf("--window-size=%d,%d", i.imageConfig.Width, i.imageConfig.Height),
-		fmt.Sprintf("--virtual-time-budget=%d", VirtualTimeBudget),
-		i.imageConfig.ScrapeURL,
-	)
-
-	cmd.Dir = i.tempDir + "/"
-	log.Debug("Starting chrome...")
-	out, err := cmd.Output()
-
-	if ctx.Err() == context.DeadlineExceeded {
-		log.Error("Chrome output: ", string(out))
-		return errors.New("Chrome timeout")
+	if accent, ok := accentColors[config.Palette]; ok {
+		i.accentColor = &accent
+	} else if config.Palette != "" && config.Palette != PaletteBlackWhite {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("unknown palette %s", config.Palette)
+	}
+	// The accent plane is only split from 1bpp images
+	if i.accentColor != nil && (config.PixelFormat != "" && config.PixelFormat != PixelFormat1bpp) {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("palette %s requires the %s pixel format instead of %s", config.Palette, PixelFormat1bpp, config.PixelFormat)
 	}
 
+	switch config.Renderer {
+	case "", RendererChrome:
+		i.renderer = &chromeRenderer{imageConfig: config, tempDir: tempDir}
+	case RendererNative:
+		i.renderer, err = newNativeRenderer(config)
+	case RendererCDP:
+		i.renderer, err = newCDPRenderer(config)
+	default:
+		err = fmt.Errorf("unknown renderer %s", config.Renderer)
+	}
 	if err != nil {
-		return err
+		os.RemoveAll(tempDir)
+		return nil, err
 	}
 
-	log.Debug("Chrome is done.")
-
-	if _, err := os.Stat(i.tempDir + "/" + chromeScreenshotFilename); err == nil {
-		return nil
+	return &i, nil
+}
+func (i *ImageProcessor) Close() error {
+	if c, ok := i.renderer.(io.Closer); ok {
+		c.Close()
+	}
+	err := os.RemoveAll(i.tempDir)
+	if err != nil {
+		log.Error("Couldn't delete temp dir:", err)
 	}
 
-	return errors.New("Screenshot was not created")
+	return err
 }
 
-func (i *ImageProcessor) Update() {
+// Update renders a new image of doc and logs the attempts through logger. If all attempts
+// fail, the last error is returned and the previous image is kept. Cancelling ctx kills a
+// running Chrome instance.
+func (i *ImageProcessor) Update(ctx context.Context, logger *log.Entry, doc *Document) error {
+	var err error
 	for t := 0; t < screenshotRetries; t++ {
-		log.Infof("Attempting screen capture try %d", t)
-		err := i.takeScreenshot()
-		if err != nil {
-			log.Error(err)
-			continue
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		screenshot, err := halfgone.LoadImage(i.tempDir + "/" + chromeScreenshotFilename)
+		logger.Infof("Attempting screen capture try %d", t)
+		var screenshot image.Image
+		start := time.Now()
+		screenshot, err = i.renderer.Render(ctx, doc)
+		metrics.RenderDuration.Observe(time.Since(start).Seconds())
 		if err != nil {
-			log.Error(err)
+			logger.Error(err)
+			metrics.RenderRetries.WithLabelValues(metrics.RetryReasonError).Inc()
 			continue
 		}
 		if isAllWhite(&screenshot) {
-			log.Error("The screenshot was all white. Let's try again...")
+			err = errors.New("screenshot was all white")
+			logger.Error("The screenshot was all white. Let's try again...")
+			metrics.RenderRetries.WithLabelValues(metrics.RetryReasonAllWhite).Inc()
 			continue
 		} else {
-			if i.imageConfig.Dithering {
+			var accent *image.Gray
+			if i.accentColor != nil {
+				screenshot, accent = splitAccent(screenshot, *i.accentColor)
+			}
+			i.currentAccent = accent
+			i.currentColor = nil
+			if i.imageConfig.PixelFormat == PixelFormatACeP {
+				i.currentColor = ditherPalette(screenshot, ACePPalette, i.imageConfig.Dithering)
+				i.currentImage = halfgone.ImageToGray(i.currentColor)
+			} else if i.bitsPerPixel > 1 {
+				levels := 1 << uint(i.bitsPerPixel)
+				i.currentImage = quantize(halfgone.ImageToGray(screenshot), levels, i.imageConfig.Dithering)
+			} else if i.imageConfig.Dithering {
 				dithered := i.ditherImage(&screenshot)
 				halfgone.SaveImagePNG(dithered, i.imageConfig.WorkingDir+"/"+ditheredFilename)
 				i.currentImage = dithered
 			} else {
-				i.currentImage = halfgone.ImageToGray(screenshot)
+				i.currentImage = thresholdImage(i.imageConfig, halfgone.ImageToGray(screenshot))
 			}
-			return
+			i.updateRefresh(i.GetImageAsBinary(), i.GetAccentAsBinary())
+			return nil
 		}
 	}
+	return err
 }
 
 func (i *ImageProcessor) ditherImage(img *image.Image) *image.Gray {
 	gray := halfgone.ImageToGray(*img)
-	dithered := halfgone.TwoRowSierraDitherer{}.Apply(gray)
+	dithered := i.ditherer.Apply(gray)
 	return dithered
 }
 
@@ -151,34 +224,63 @@ func isAllWhite(img *image.Image) bool {
 	return true
 }
 
+// GetImage returns the current image or nil if no image was rendered yet.
+func (i *ImageProcessor) GetImage() *image.Gray {
+	return i.currentImage
+}
+
 // GetImageAsBinary returns a one-dimensional byte array for all the pixels in the current image.
-// Each bit represents one pixel.
+// Each pixel occupies the number of bits of the pixel format.
 func (i *ImageProcessor) GetImageAsBinary() []byte {
+	if i.currentColor != nil {
+		return packIndexed(i.currentColor, i.bitsPerPixel, i.imageConfig.Packing)
+	}
 	if i.currentImage == nil {
 		return nil
 	}
+	return pack(i.currentImage, i.bitsPerPixel, i.imageConfig.Packing)
+}
 
-	bounds := i.currentImage.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-
-	data := make([]byte, width*height/8)
-	index := 0
+// Format describes the layout of the data returned by GetImageAsBinary
+func (i *ImageProcessor) Format() Format {
+	pixelFormat := i.imageConfig.PixelFormat
+	if pixelFormat == "" {
+		pixelFormat = PixelFormat1bpp
+	}
+	width, height := i.imageConfig.Packing.size(i.imageConfig.Width, i.imageConfig.Height)
+	format := Format{
+		PixelFormat:  pixelFormat,
+		BitsPerPixel: i.bitsPerPixel,
+		Width:        width,
+		Height:       height,
+		Stride:       i.imageConfig.Packing.stride(i.imageConfig.Width, i.imageConfig.Height, i.bitsPerPixel),
+		Packing:      i.imageConfig.Packing,
+	}
+	if pixelFormat == PixelFormatACeP {
+		format.Palette = paletteHex(ACePPalette)
+	}
+	return format
+}
 
-	for h := 0; h < height; h++ {
-		for w := 0; w < width; w += 8 {
-			// Now, we need to shrink every 8 pixels into one byte
-			var b byte
-			for x := 0; x < 8; x++ {
-				px := i.currentImage.GrayAt(w+x, h)
-				if px.Y != 0 {
-					b |= 1 << (7 - x)
-				}
-			}
-			data[index] = b
-			index++
-		}
+// GetColorImage returns the current image of color pixel formats or nil otherwise
+func (i *ImageProcessor) GetColorImage() image.Image {
+	if i.currentColor == nil {
+		return nil
 	}
+	return i.currentColor
+}
 
-	return data
+// GetAccentImage returns the accent plane of tri-color palettes, in which accent pixels
+// are black. nil is returned for black and white.
+func (i *ImageProcessor) GetAccentImage() *image.Gray {
+	return i.currentAccent
+}
+
+// GetAccentAsBinary packs the accent plane with one bit per pixel, a 0 bit marks an accent pixel.
+// nil is returned for black and white.
+func (i *ImageProcessor) GetAccentAsBinary() []byte {
+	if i.currentAccent == nil {
+		return nil
+	}
+	return pack(i.currentAccent, 1, i.imageConfig.Packing)
 }
@@ -0,0 +1,272 @@
+package imaging
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/net/html"
+)
+
+const (
+	// Sizes in px, matching templates/index.gohtml and static/style.css
+	nativeFontSize       = 36
+	nativeReportIconSize = 50
+	nativeFooterFontSize = 16
+	nativeMargin         = nativeFontSize
+	nativeBlockSpacing   = nativeFontSize / 2
+
+	// textFontFile is the OpenType version of the web font used by static/style.css
+	textFontFile        = "vollkorn/Vollkorn-Regular.otf"
+	fontAwesomeFontFile = "fontawesome/webfonts/fa-solid-900.ttf"
+	fontAwesomeCSSFile  = "fontawesome/css/all.min.css"
+)
+
+var fontAwesomeIconPattern = regexp.MustCompile(`\.fa-([a-z0-9-]+):before\{content:"\\([0-9a-f]+)"\}`)
+
+// nativeRenderer lays out documents without a browser. Text uses FontFile or the
+// Vollkorn font of the web page, icons use the Font Awesome font. Both are shipped
+// in the static folder.
+type nativeRenderer struct {
+	width     int
+	height    int
+	iconCodes map[string]rune
+	// Faces are created once as they cache glyphs. They aren't safe for concurrent
+	// use, but an image processor never renders concurrently.
+	text       font.Face
+	icons      font.Face
+	reportIcon font.Face
+	footer     font.Face
+}
+
+func newNativeRenderer(config *ImageConfig) (*nativeRenderer, error) {
+	return loadNativeRenderer(config, "static")
+}
+
+func loadNativeRenderer(config *ImageConfig, staticDir string) (*nativeRenderer, error) {
+	r := nativeRenderer{width: config.Width, height: config.Height}
+
+	textFontFile := staticDir + "/" + textFontFile
+	if config.FontFile != "" {
+		textFontFile = config.FontFile
+	}
+	textFontData, err := ioutil.ReadFile(textFontFile)
+	if err != nil {
+		return nil, err
+	}
+	textFont, err := opentype.Parse(textFontData)
+	if err != nil {
+		return nil, err
+	}
+
+	iconFontData, err := ioutil.ReadFile(staticDir + "/" + fontAwesomeFontFile)
+	if err != nil {
+		return nil, err
+	}
+	iconFont, err := opentype.Parse(iconFontData)
+	if err != nil {
+		return nil, err
+	}
+
+	css, err := ioutil.ReadFile(staticDir + "/" + fontAwesomeCSSFile)
+	if err != nil {
+		return nil, err
+	}
+	r.iconCodes = parseFontAwesomeCSS(string(css))
+
+	faces := []struct {
+		face *font.Face
+		font *opentype.Font
+		size float64
+	}{
+		{&r.text, textFont, nativeFontSize},
+		{&r.icons, iconFont, nativeFontSize},
+		{&r.reportIcon, iconFont, nativeReportIconSize},
+		{&r.footer, textFont, nativeFooterFontSize},
+	}
+	for _, f := range faces {
+		*f.face, err = newFace(f.font, f.size)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+
+	return &r, nil
+}
+
+// Close releases the faces
+func (r *nativeRenderer) Close() error {
+	for _, face := range []font.Face{r.text, r.icons, r.reportIcon, r.footer} {
+		if face != nil {
+			face.Close()
+		}
+	}
+	return nil
+}
+
+// parseFontAwesomeCSS extracts the code points of all icons from the Font Awesome style sheet
+func parseFontAwesomeCSS(css string) map[string]rune {
+	codes := map[string]rune{}
+	for _, match := range fontAwesomeIconPattern.FindAllStringSubmatch(css, -1) {
+		code, err := strconv.ParseInt(match[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		codes[match[1]] = rune(code)
+	}
+	return codes
+}
+
+func newFace(f *opentype.Font, size float64) (font.Face, error) {
+	return opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+}
+
+func (r *nativeRenderer) Render(ctx context.Context, doc *Document) (image.Image, error) {
+	text, icons, reportIcon, footer := r.text, r.icons, r.reportIcon, r.footer
+
+	img := image.NewGray(image.Rect(0, 0, r.width, r.height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	maxWidth := r.width - 2*nativeMargin
+
+	y := nativeMargin
+	y = r.drawParagraph(img, y, maxWidth, []fragment{{text: doc.Greeting}}, text, icons)
+
+	// Weather icon followed by the vertically centered report
+	y += nativeBlockSpacing
+	x := nativeMargin
+	reportHeight := reportIcon.Metrics().Height.Ceil()
+	if code, ok := r.iconCodes[doc.Icon]; ok {
+		drawString(img, reportIcon, x, y+reportIcon.Metrics().Ascent.Ceil(), string(code))
+		x += font.MeasureString(reportIcon, string(code)).Ceil() + nativeBlockSpacing
+	}
+	textOffset := (reportHeight - text.Metrics().Height.Ceil()) / 2
+	drawString(img, text, x, y+textOffset+text.Metrics().Ascent.Ceil(), doc.Report)
+	y += reportHeight + nativeBlockSpacing
+
+	for _, m := range doc.Messages {
+		fragments := r.parseMessage(m)
+		if len(fragments) == 0 {
+			continue
+		}
+		y += nativeBlockSpacing
+		y = r.drawParagraph(img, y, maxWidth, fragments, text, icons)
+	}
+
+	// The footer is aligned to the bottom
+	lineHeight := footer.Metrics().Height.Ceil()
+	y = r.height - nativeFooterFontSize - len(doc.Footer)*lineHeight
+	for _, line := range doc.Footer {
+		drawString(img, footer, nativeMargin, y+footer.Metrics().Ascent.Ceil(), line)
+		y += lineHeight
+	}
+
+	return img, nil
+}
+
+// fragment is a word or an icon of a message
+type fragment struct {
+	text        string
+	icon        rune
+	spaceBefore bool
+}
+
+// parseMessage splits an HTML message into words and Font Awesome icons (<i class="fas fa-...">).
+// All other tags are ignored.
+func (r *nativeRenderer) parseMessage(message string) []fragment {
+	fragments := []fragment{}
+	pendingSpace := false
+	tokenizer := html.NewTokenizer(strings.NewReader(message))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return fragments
+		case html.TextToken:
+			text := string(tokenizer.Text())
+			if text == "" {
+				continue
+			}
+			if unicode.IsSpace(rune(text[0])) {
+				pendingSpace = true
+			}
+			for _, word := range strings.Fields(text) {
+				fragments = append(fragments, fragment{text: word, spaceBefore: pendingSpace && len(fragments) > 0})
+				pendingSpace = true
+			}
+			pendingSpace = unicode.IsSpace(rune(text[len(text)-1]))
+		case html.StartTagToken:
+			token := tokenizer.Token()
+			if token.Data != "i" {
+				continue
+			}
+			for _, attr := range token.Attr {
+				if attr.Key != "class" {
+					continue
+				}
+				for _, class := range strings.Fields(attr.Val) {
+					if !strings.HasPrefix(class, "fa-") {
+						continue
+					}
+					if code, ok := r.iconCodes[strings.TrimPrefix(class, "fa-")]; ok {
+						fragments = append(fragments, fragment{icon: code, spaceBefore: pendingSpace && len(fragments) > 0})
+						pendingSpace = false
+					}
+				}
+			}
+		}
+	}
+}
+
+// drawParagraph draws the fragments starting at y, wrapping lines at maxWidth.
+// The y coordinate below the paragraph is returned.
+func (r *nativeRenderer) drawParagraph(img draw.Image, y int, maxWidth int, fragments []fragment, text font.Face, icons font.Face) int {
+	lineHeight := text.Metrics().Height.Ceil()
+	ascent := text.Metrics().Ascent.Ceil()
+	spaceWidth := font.MeasureString(text, " ").Ceil()
+
+	x := 0
+	for i, f := range fragments {
+		face := text
+		s := f.text
+		if f.icon != 0 {
+			face = icons
+			s = string(f.icon)
+		}
+		width := font.MeasureString(face, s).Ceil()
+		if f.spaceBefore && x > 0 {
+			x += spaceWidth
+		}
+		if x > 0 && x+width > maxWidth {
+			x = 0
+			y += lineHeight
+		}
+		drawString(img, face, nativeMargin+x, y+ascent, s)
+		x += width
+		if i == len(fragments)-1 {
+			y += lineHeight
+		}
+	}
+	return y
+}
+
+func drawString(img draw.Image, face font.Face, x int, baseline int, s string) {
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.Black,
+		Face: face,
+		Dot:  fixed.P(x, baseline),
+	}
+	d.DrawString(s)
+}
@@ -0,0 +1,78 @@
+package imaging
+
+import (
+	"context"
+	"image"
+	"testing"
+)
+
+func testNativeRenderer(t *testing.T) *nativeRenderer {
+	r, err := loadNativeRenderer(&ImageConfig{Width: 800, Height: 480}, "../static")
+	if err != nil {
+		t.Fatal("Could not create renderer: ", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestParseMessage(t *testing.T) {
+	r := testNativeRenderer(t)
+	if r.iconCodes["umbrella"] != 0xf0e9 {
+		t.Errorf("Unexpected code point for umbrella: %x", r.iconCodes["umbrella"])
+	}
+
+	fragments := r.parseMessage("Take an <i class='fas fa-umbrella'></i>. <b>Really</b>!")
+	expected := []fragment{
+		{text: "Take"},
+		{text: "an", spaceBefore: true},
+		{icon: 0xf0e9, spaceBefore: true},
+		{text: "."},
+		{text: "Really", spaceBefore: true},
+		{text: "!"},
+	}
+	if len(fragments) != len(expected) {
+		t.Fatalf("Expected %d fragments but got %v", len(expected), fragments)
+	}
+	for i := range expected {
+		if fragments[i] != expected[i] {
+			t.Errorf("Fragment %d: expected %v but got %v", i, expected[i], fragments[i])
+		}
+	}
+}
+
+func TestNativeRender(t *testing.T) {
+	r := testNativeRenderer(t)
+	doc := Document{
+		Greeting: "Hey there.",
+		Icon:     "cloud-rain",
+		Report:   "Rainy, 12°C",
+		Messages: []string{"Take an <i class='fas fa-umbrella'></i>.", "A very long message that certainly doesn't fit into a single line of the display and has to be wrapped."},
+		Footer:   []string{"Displaying data for Berlin", "?2w test"},
+	}
+	img, err := r.Render(context.Background(), &doc)
+	if err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+	if img.Bounds().Dx() != 800 || img.Bounds().Dy() != 480 {
+		t.Errorf("Unexpected image size %v", img.Bounds())
+	}
+	if isAllWhite(&img) {
+		t.Error("The image was all white")
+	}
+}
+
+func TestWrapping(t *testing.T) {
+	r := testNativeRenderer(t)
+	text, icons := r.text, r.icons
+	img := image.NewGray(image.Rect(0, 0, 800, 480))
+	lineHeight := text.Metrics().Height.Ceil()
+
+	short := r.drawParagraph(img, 0, 700, r.parseMessage("short"), text, icons)
+	long := r.drawParagraph(img, 0, 700, r.parseMessage("A very long message that certainly doesn't fit into a single line of the display."), text, icons)
+	if short != lineHeight {
+		t.Errorf("Expected one line (%d) but got %d", lineHeight, short)
+	}
+	if long != 2*lineHeight {
+		t.Errorf("Expected two lines (%d) but got %d", 2*lineHeight, long)
+	}
+}
@@ -0,0 +1,234 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Available pixel formats of the packed display buffer
+const (
+	PixelFormat1bpp = "1bpp"
+	PixelFormat2bpp = "2bpp"
+	PixelFormat4bpp = "4bpp"
+)
+
+var pixelFormatBits = map[string]int{
+	PixelFormat1bpp: 1,
+	PixelFormat2bpp: 2,
+	PixelFormat4bpp: 4,
+	PixelFormatACeP: 4,
+}
+
+// BitsPerPixel returns the number of bits a pixel occupies in the given pixel format
+func BitsPerPixel(pixelFormat string) (int, error) {
+	if pixelFormat == "" {
+		return 1, nil
+	}
+	bits, ok := pixelFormatBits[pixelFormat]
+	if !ok {
+		return 0, fmt.Errorf("unsupported pixel format %s", pixelFormat)
+	}
+	return bits, nil
+}
+
+// Bit orders within a byte
+const (
+	BitOrderMSB = "msb"
+	BitOrderLSB = "lsb"
+)
+
+// Packing describes how the pixels are arranged in the display buffer. The zero value
+// packs rows from the top left, most significant bits first, with 0 being black.
+type Packing struct {
+	// BitOrder is BitOrderMSB (default) or BitOrderLSB for the first pixel of a byte
+	BitOrder string `yaml:"bit_order" json:"bit_order,omitempty"`
+	// Inverted flips all values, so 0 is white. It isn't supported by indexed pixel formats.
+	Inverted bool `yaml:"inverted" json:"inverted"`
+	// Rotation clockwise in degrees: 0, 90, 180, or 270
+	Rotation int `yaml:"rotation" json:"rotation"`
+	// MirrorHorizontal and MirrorVertical flip the image after rotating it
+	MirrorHorizontal bool `yaml:"mirror_horizontal" json:"mirror_horizontal"`
+	MirrorVertical   bool `yaml:"mirror_vertical" json:"mirror_vertical"`
+	// ColumnMajor packs columns from top to bottom instead of rows from left to right
+	ColumnMajor bool `yaml:"column_major" json:"column_major"`
+}
+
+func (p Packing) validate(pixelFormat string) error {
+	// Flipping palette indices would select unrelated colors
+	if p.Inverted && pixelFormat == PixelFormatACeP {
+		return fmt.Errorf("inverted isn't supported by the %s pixel format", pixelFormat)
+	}
+	if p.BitOrder != "" && p.BitOrder != BitOrderMSB && p.BitOrder != BitOrderLSB {
+		return fmt.Errorf("unknown bit order %s", p.BitOrder)
+	}
+	if p.Rotation != 0 && p.Rotation != 90 && p.Rotation != 180 && p.Rotation != 270 {
+		return fmt.Errorf("unsupported rotation %d", p.Rotation)
+	}
+	return nil
+}
+
+// size returns the dimensions of an image of the given size after rotating it
+func (p Packing) size(width int, height int) (int, int) {
+	if p.Rotation == 90 || p.Rotation == 270 {
+		return height, width
+	}
+	return width, height
+}
+
+// lines returns the number of lines of the display buffer and the number of pixels per line
+func (p Packing) lines(width int, height int) (int, int) {
+	outWidth, outHeight := p.size(width, height)
+	if p.ColumnMajor {
+		return outWidth, outHeight
+	}
+	return outHeight, outWidth
+}
+
+// stride returns the number of bytes per line. Every line starts at a byte boundary, so
+// the last byte of a line is padded with 0 bits if its pixels don't fill it.
+func (p Packing) stride(width int, height int, bits int) int {
+	_, length := p.lines(width, height)
+	return (length*bits + 7) / 8
+}
+
+// source returns the pixel of a width x height image that ends up at (x, y)
+// after rotating and mirroring it.
+func (p Packing) source(x int, y int, width int, height int) (int, int) {
+	outWidth, outHeight := p.size(width, height)
+	if p.MirrorHorizontal {
+		x = outWidth - 1 - x
+	}
+	if p.MirrorVertical {
+		y = outHeight - 1 - y
+	}
+	switch p.Rotation {
+	case 90:
+		return y, height - 1 - x
+	case 180:
+		return width - 1 - x, height - 1 - y
+	case 270:
+		return width - 1 - y, x
+	}
+	return x, y
+}
+
+// Format describes the packed display buffer so clients can decode it. Width and
+// Height are the dimensions after rotation.
+type Format struct {
+	PixelFormat  string `json:"pixel_format"`
+	BitsPerPixel int    `json:"bits_per_pixel"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	// Stride is the number of bytes per row, or per column if the packing is column major
+	Stride int `json:"stride"`
+	// Palette lists the colors of indexed formats in the order of their indices
+	Palette []string `json:"palette,omitempty"`
+	Packing Packing  `json:"packing"`
+	// Encoding is the compression of the data, if any
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// pack converts img into the display buffer. Each pixel is the index of its gray level,
+// 0 being black. With 1 bit per pixel, pixels brighter than the default threshold are white.
+// Update already converts 1 bit images to black and white with the configured threshold.
+func pack(img *image.Gray, bits int, packing Packing) []byte {
+	maxLevel := 1<<uint(bits) - 1
+	return packValues(img.Bounds(), bits, packing, func(x int, y int) byte {
+		px := img.GrayAt(x, y)
+		if bits == 1 {
+			if px.Y > defaultThreshold {
+				return 1
+			}
+			return 0
+		}
+		return byte((int(px.Y)*maxLevel + 127) / 255)
+	})
+}
+
+// packIndexed packs the palette indices of img
+func packIndexed(img *image.Paletted, bits int, packing Packing) []byte {
+	return packValues(img.Bounds(), bits, packing, func(x int, y int) byte {
+		return img.ColorIndexAt(x, y)
+	})
+}
+
+// packValues packs the values of all pixels within bounds as described by packing
+func packValues(bounds image.Rectangle, bits int, packing Packing, value func(x int, y int) byte) []byte {
+	width := bounds.Dx()
+	height := bounds.Dy()
+	pixelsPerByte := 8 / bits
+	maxValue := byte(1<<uint(bits) - 1)
+
+	// Lines are the rows or columns of the rotated image
+	lines, lineLength := packing.lines(width, height)
+	stride := packing.stride(width, height, bits)
+	data := make([]byte, lines*stride)
+
+	for l := 0; l < lines; l++ {
+		for p := 0; p < lineLength; p++ {
+			x, y := p, l
+			if packing.ColumnMajor {
+				x, y = l, p
+			}
+			x, y = packing.source(x, y, width, height)
+			v := value(bounds.Min.X+x, bounds.Min.Y+y)
+			if packing.Inverted {
+				v = maxValue - v
+			}
+			i := p % pixelsPerByte
+			if packing.BitOrder == BitOrderLSB {
+				data[l*stride+p/pixelsPerByte] |= v << uint(bits*i)
+			} else {
+				data[l*stride+p/pixelsPerByte] |= v << uint(8-bits*(i+1))
+			}
+		}
+	}
+
+	return data
+}
+
+// quantize reduces img to the given number of evenly spaced gray levels. With dither set,
+// the quantization error is spread with Floyd-Steinberg error diffusion.
+func quantize(img *image.Gray, levels int, dither bool) *image.Gray {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	step := 255.0 / float64(levels-1)
+
+	values := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			values[y*width+x] = float64(img.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y)
+		}
+	}
+	spread := func(x int, y int, e float64) {
+		if x >= 0 && x < width && y < height {
+			values[y*width+x] += e
+		}
+	}
+
+	quantized := image.NewGray(bounds)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			old := values[y*width+x]
+			level := int(old/step + 0.5)
+			if level < 0 {
+				level = 0
+			} else if level > levels-1 {
+				level = levels - 1
+			}
+			v := float64(level) * step
+			quantized.SetGray(bounds.Min.X+x, bounds.Min.Y+y, color.Gray{Y: uint8(v + 0.5)})
+
+			if dither {
+				e := old - v
+				spread(x+1, y, e*7/16)
+				spread(x-1, y+1, e*3/16)
+				spread(x, y+1, e*5/16)
+				spread(x+1, y+1, e*1/16)
+			}
+		}
+	}
+	return quantized
+}
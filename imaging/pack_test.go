@@ -0,0 +1,291 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+func TestPack(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 8, 1))
+	for x, y := range []uint8{0, 85, 170, 255, 0, 255, 1, 128} {
+		img.SetGray(x, 0, color.Gray{Y: y})
+	}
+
+	tests := []struct {
+		bits     int
+		expected []byte
+	}{
+		// With 1 bit per pixel, everything brighter than 127 is white
+		{1, []byte{0x35}},
+		{2, []byte{0x1b, 0x32}},
+		{4, []byte{0x05, 0xaf, 0x0f, 0x08}},
+	}
+	for _, test := range tests {
+		data := pack(img, test.bits, Packing{})
+		if !bytes.Equal(data, test.expected) {
+			t.Errorf("%d bits per pixel: expected %x but got %x", test.bits, test.expected, data)
+		}
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 64, 4))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 4; y++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x * 4)})
+		}
+	}
+
+	for _, dither := range []bool{false, true} {
+		quantized := quantize(img, 4, dither)
+		sum := 0
+		for x := 0; x < 64; x++ {
+			for y := 0; y < 4; y++ {
+				v := quantized.GrayAt(x, y).Y
+				if v != 0 && v != 85 && v != 170 && v != 255 {
+					t.Fatalf("Pixel (%d, %d) isn't one of the four levels: %d", x, y, v)
+				}
+				sum += int(v)
+			}
+		}
+		// Dithering has to preserve the average brightness
+		if dither && (sum/256 < 120 || sum/256 > 132) {
+			t.Errorf("Unexpected average brightness %d", sum/256)
+		}
+	}
+}
+
+func TestBitsPerPixel(t *testing.T) {
+	if bits, err := BitsPerPixel(""); err != nil || bits != 1 {
+		t.Error("The default should be 1 bit per pixel")
+	}
+	if bits, err := BitsPerPixel(PixelFormat4bpp); err != nil || bits != 4 {
+		t.Error("Unexpected bits per pixel for 4bpp: ", bits)
+	}
+	if _, err := BitsPerPixel("24bpp"); err == nil {
+		t.Error("An error should have been returned")
+	}
+}
+
+// unpack reverses packValues, returning the value of every pixel of the original width x height image
+func unpack(data []byte, bits int, packing Packing, width int, height int) [][]byte {
+	outWidth, outHeight := width, height
+	if packing.Rotation == 90 || packing.Rotation == 270 {
+		outWidth, outHeight = height, width
+	}
+	lines, lineLength := outHeight, outWidth
+	if packing.ColumnMajor {
+		lines, lineLength = outWidth, outHeight
+	}
+	stride := (lineLength*bits + 7) / 8
+	pixelsPerByte := 8 / bits
+	mask := byte(1<<uint(bits) - 1)
+
+	out := make([][]byte, outHeight)
+	for y := range out {
+		out[y] = make([]byte, outWidth)
+	}
+	for l := 0; l < lines; l++ {
+		for p := 0; p < lineLength; p++ {
+			i := p % pixelsPerByte
+			shift := uint(8 - bits*(i+1))
+			if packing.BitOrder == BitOrderLSB {
+				shift = uint(bits * i)
+			}
+			v := data[l*stride+p/pixelsPerByte] >> shift & mask
+			if packing.Inverted {
+				v = mask - v
+			}
+			x, y := p, l
+			if packing.ColumnMajor {
+				x, y = l, p
+			}
+			if packing.MirrorHorizontal {
+				x = outWidth - 1 - x
+			}
+			if packing.MirrorVertical {
+				y = outHeight - 1 - y
+			}
+			out[y][x] = v
+		}
+	}
+
+	result := make([][]byte, height)
+	for y := range result {
+		result[y] = make([]byte, width)
+	}
+	for y := 0; y < outHeight; y++ {
+		for x := 0; x < outWidth; x++ {
+			switch packing.Rotation {
+			case 0:
+				result[y][x] = out[y][x]
+			case 90:
+				result[height-1-x][y] = out[y][x]
+			case 180:
+				result[height-1-y][width-1-x] = out[y][x]
+			case 270:
+				result[x][width-1-y] = out[y][x]
+			}
+		}
+	}
+	return result
+}
+
+// randomGray returns an image with random pixels of the gray levels available with the given bits
+func randomGray(rng *rand.Rand, width int, height int, bits int) *image.Gray {
+	maxLevel := 1<<uint(bits) - 1
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(rng.Intn(maxLevel+1) * 255 / maxLevel)})
+		}
+	}
+	return img
+}
+
+func checkRoundTrip(t *testing.T, img *image.Gray, bits int, packing Packing) {
+	t.Helper()
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	maxLevel := 1<<uint(bits) - 1
+
+	data := pack(img, bits, packing)
+	lines, _ := packing.lines(width, height)
+	if len(data) != lines*packing.stride(width, height, bits) {
+		t.Fatalf("%dx%d, %d bits, %+v: unexpected length %d", width, height, bits, packing, len(data))
+	}
+	values := unpack(data, bits, packing, width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			expected := byte(int(img.GrayAt(x, y).Y) * maxLevel / 255)
+			if values[y][x] != expected {
+				t.Fatalf("%dx%d, %d bits, %+v: pixel (%d, %d) is %d instead of %d", width, height, bits, packing, x, y, values[y][x], expected)
+			}
+		}
+	}
+}
+
+func TestPackingRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for _, size := range []image.Point{{16, 8}, {13, 5}} {
+		for _, bits := range []int{1, 2, 4} {
+			img := randomGray(rng, size.X, size.Y, bits)
+			for _, bitOrder := range []string{BitOrderMSB, BitOrderLSB} {
+				for _, rotation := range []int{0, 90, 180, 270} {
+					for flags := 0; flags < 16; flags++ {
+						checkRoundTrip(t, img, bits, Packing{
+							BitOrder:         bitOrder,
+							Rotation:         rotation,
+							Inverted:         flags&1 != 0,
+							MirrorHorizontal: flags&2 != 0,
+							MirrorVertical:   flags&4 != 0,
+							ColumnMajor:      flags&8 != 0,
+						})
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPackOddSizes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		width, height int
+		bits          int
+		packing       Packing
+		stride        int
+	}{
+		{122, 250, 1, Packing{}, 16},
+		{122, 250, 2, Packing{}, 31},
+		{122, 250, 1, Packing{Rotation: 90}, 32},
+		{122, 250, 1, Packing{ColumnMajor: true}, 32},
+		{296, 128, 1, Packing{}, 37},
+		{296, 128, 4, Packing{}, 148},
+		{296, 128, 1, Packing{Rotation: 270, BitOrder: BitOrderLSB}, 16},
+	}
+	for _, test := range tests {
+		if stride := test.packing.stride(test.width, test.height, test.bits); stride != test.stride {
+			t.Errorf("%dx%d, %d bits, %+v: stride is %d instead of %d", test.width, test.height, test.bits, test.packing, stride, test.stride)
+		}
+		checkRoundTrip(t, randomGray(rng, test.width, test.height, test.bits), test.bits, test.packing)
+	}
+}
+
+func TestPackPadding(t *testing.T) {
+	// Two white rows of 3 pixels, each padded to a full byte
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	tests := []struct {
+		packing  Packing
+		expected []byte
+	}{
+		{Packing{}, []byte{0xe0, 0xe0}},
+		{Packing{BitOrder: BitOrderLSB}, []byte{0x07, 0x07}},
+		{Packing{ColumnMajor: true}, []byte{0xc0, 0xc0, 0xc0}},
+	}
+	for _, test := range tests {
+		data := pack(img, 1, test.packing)
+		if !bytes.Equal(data, test.expected) {
+			t.Errorf("%+v: got %x instead of %x", test.packing, data, test.expected)
+		}
+	}
+}
+
+func TestPackingLayout(t *testing.T) {
+	// A single black pixel in the top left corner
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	img.SetGray(0, 0, color.Gray{Y: 0})
+
+	tests := []struct {
+		packing Packing
+		index   int
+		value   byte
+	}{
+		{Packing{}, 0, 0x7f},
+		{Packing{BitOrder: BitOrderLSB}, 0, 0xfe},
+		{Packing{Inverted: true}, 0, 0x80},
+		{Packing{Rotation: 90}, 0, 0xfe},
+		{Packing{Rotation: 180}, 7, 0xfe},
+		{Packing{Rotation: 270}, 7, 0x7f},
+		{Packing{MirrorVertical: true}, 7, 0x7f},
+		{Packing{ColumnMajor: true, Rotation: 90}, 7, 0x7f},
+	}
+	for _, test := range tests {
+		data := pack(img, 1, test.packing)
+		for i, b := range data {
+			expected := byte(0xff)
+			if test.packing.Inverted {
+				expected = 0x00
+			}
+			if i == test.index {
+				expected = test.value
+			}
+			if b != expected {
+				t.Errorf("%+v: byte %d is %x instead of %x", test.packing, i, b, expected)
+			}
+		}
+	}
+}
+
+func TestPackingValidation(t *testing.T) {
+	if (Packing{Rotation: 45}).validate(PixelFormat1bpp) == nil {
+		t.Error("A rotation of 45 degrees should be rejected")
+	}
+	if (Packing{BitOrder: "middle"}).validate(PixelFormat1bpp) == nil {
+		t.Error("An unknown bit order should be rejected")
+	}
+	if (Packing{Inverted: true}).validate(PixelFormatACeP) == nil {
+		t.Error("Inverting palette indices should be rejected")
+	}
+	if (Packing{Inverted: true}).validate(PixelFormat4bpp) != nil {
+		t.Error("Inverting gray levels should be allowed")
+	}
+}
@@ -0,0 +1,74 @@
+package imaging
+
+import (
+	"errors"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const pageFilename = "index.html"
+
+var (
+	headPattern         = regexp.MustCompile(`(?i)<head[^>]*>`)
+	rootRelativePattern = regexp.MustCompile(`((?:href|src)\s*=\s*["'])/([^/])`)
+)
+
+// pageURL returns the URL a browser has to render for a document. ScrapeURL takes
+// precedence, otherwise the HTML of the document is written to dir. It is used by
+// the chrome renderer, which can only load URLs.
+func pageURL(config *ImageConfig, dir string, doc *Document) (string, error) {
+	if config.ScrapeURL != "" {
+		return config.ScrapeURL, nil
+	}
+	if doc == nil || doc.HTML == "" {
+		return "", errors.New("neither a scrape URL nor HTML to render")
+	}
+	return writePage(dir, doc)
+}
+
+// pageHTML returns the HTML of a document with its assets resolved against the
+// document's AssetDir: a <base> element is added and root-relative paths
+// (e.g. /style.css) are made relative.
+func pageHTML(doc *Document) (string, error) {
+	assetDir, err := filepath.Abs(doc.AssetDir)
+	if err != nil {
+		return "", err
+	}
+	base := `<base href="` + html.EscapeString(fileURL(assetDir)+"/") + `">`
+
+	page := rootRelativePattern.ReplaceAllString(doc.HTML, "${1}${2}")
+	if loc := headPattern.FindStringIndex(page); loc != nil {
+		page = page[:loc[1]] + base + page[loc[1]:]
+	} else {
+		page = base + page
+	}
+	return page, nil
+}
+
+// writePage stores the HTML of a document in dir so it can be loaded from disk
+func writePage(dir string, doc *Document) (string, error) {
+	page, err := pageHTML(doc)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, pageFilename)
+	err = ioutil.WriteFile(path, []byte(page), 0600)
+	if err != nil {
+		return "", err
+	}
+	return fileURL(path), nil
+}
+
+func fileURL(path string) string {
+	p := filepath.ToSlash(path)
+	if !strings.HasPrefix(p, "/") {
+		// Windows paths like C:/...
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
@@ -0,0 +1,41 @@
+package imaging
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePage(t *testing.T) {
+	dir := t.TempDir()
+	doc := Document{
+		HTML:     `<html><head><link rel="stylesheet" href="style.css"><link href="/fontawesome/css/all.min.css" rel="stylesheet"><script src="//cdn.example.com/x.js"></script></head></html>`,
+		AssetDir: "../static",
+	}
+	u, err := writePage(dir, &doc)
+	if err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "file" {
+		t.Fatalf("Invalid page URL %s", u)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, pageFilename))
+	if err != nil {
+		t.Fatal("Could not read page: ", err)
+	}
+	page := string(data)
+	assetDir, _ := filepath.Abs("../static")
+	if !strings.Contains(page, `<head><base href="`+fileURL(assetDir)+`/">`) {
+		t.Error("The base element is missing: ", page)
+	}
+	if !strings.Contains(page, `href="fontawesome/css/all.min.css"`) {
+		t.Error("The root-relative path wasn't rewritten: ", page)
+	}
+	if !strings.Contains(page, `src="//cdn.example.com/x.js"`) {
+		t.Error("The protocol-relative URL shouldn't be rewritten: ", page)
+	}
+}
@@ -0,0 +1,50 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+)
+
+// Available palettes. Tri-color palettes add an accent color to black and white.
+const (
+	PaletteBlackWhite       = "bw"
+	PaletteBlackWhiteRed    = "bwr"
+	PaletteBlackWhiteYellow = "bwy"
+)
+
+var accentColors = map[string]color.RGBA{
+	PaletteBlackWhiteRed:    {R: 255, A: 255},
+	PaletteBlackWhiteYellow: {R: 255, G: 255, A: 255},
+}
+
+// splitAccent assigns every pixel to the closest of black, white, and the accent color.
+// It returns a copy of img in which the accent pixels are white and the accent plane,
+// in which they are black.
+func splitAccent(img image.Image, accent color.RGBA) (image.Image, *image.Gray) {
+	bounds := img.Bounds()
+	rest := image.NewRGBA(bounds)
+	plane := image.NewGray(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			d := distance(c, accent)
+			if d < distance(c, color.RGBA{A: 255}) && d < distance(c, color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+				rest.SetRGBA(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+				plane.SetGray(x, y, color.Gray{Y: 0})
+			} else {
+				rest.SetRGBA(x, y, c)
+				plane.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return rest, plane
+}
+
+// distance returns the squared euclidean distance of two colors in RGB space
+func distance(a color.RGBA, b color.RGBA) int {
+	dr := int(a.R) - int(b.R)
+	dg := int(a.G) - int(b.G)
+	db := int(a.B) - int(b.B)
+	return dr*dr + dg*dg + db*db
+}
@@ -0,0 +1,38 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSplitAccent(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	img.SetRGBA(0, 0, color.RGBA{A: 255})
+	img.SetRGBA(1, 0, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	img.SetRGBA(2, 0, color.RGBA{R: 220, G: 30, B: 40, A: 255})
+	img.SetRGBA(3, 0, color.RGBA{R: 240, G: 200, B: 200, A: 255})
+
+	rest, plane := splitAccent(img, accentColors[PaletteBlackWhiteRed])
+
+	expectedPlane := []uint8{255, 255, 0, 255}
+	for x, expected := range expectedPlane {
+		if plane.GrayAt(x, 0).Y != expected {
+			t.Errorf("Pixel %d: expected %d in the accent plane but got %d", x, expected, plane.GrayAt(x, 0).Y)
+		}
+	}
+	if c := color.RGBAModel.Convert(rest.At(2, 0)).(color.RGBA); c != (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Errorf("The accent pixel should be white in the remaining image but was %v", c)
+	}
+	if c := color.RGBAModel.Convert(rest.At(0, 0)).(color.RGBA); c != (color.RGBA{A: 255}) {
+		t.Errorf("The black pixel should be kept but was %v", c)
+	}
+}
+
+func TestPaletteRequires1bpp(t *testing.T) {
+	for _, format := range []string{PixelFormat2bpp, PixelFormat4bpp, PixelFormatACeP} {
+		if _, err := New(&ImageConfig{Palette: PaletteBlackWhiteRed, PixelFormat: format}); err == nil {
+			t.Errorf("The bwr palette should be rejected for %s", format)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package imaging
+
+import (
+	"image"
+)
+
+const (
+	// Changed areas closer than this many lines or bytes are merged into one region
+	mergeLines = 8
+	mergeBytes = 2
+	// More regions or a larger changed area than this require a full refresh
+	maxRegions      = 8
+	maxPartialShare = 0.5
+	// defaultFullRefreshEvery is used if FullRefreshEvery isn't set
+	defaultFullRefreshEvery = 10
+)
+
+// PartialRefreshConfig enables publishing the regions that changed since the previous image
+type PartialRefreshConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// FullRefreshEvery forces a full refresh after this many partial ones to clear ghosting.
+	// 0 uses the default of 10.
+	FullRefreshEvery int `yaml:"full_refresh_every"`
+}
+
+// Region is a rectangle of the display buffer that changed. The coordinates refer to the
+// packed image, i.e. after rotation. Data and Accent contain the lines of the region packed
+// like the display buffer, each line starting at a byte boundary.
+type Region struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Data   []byte `json:"data,omitempty"`
+	Accent []byte `json:"accent,omitempty"`
+}
+
+// Refresh describes how a display gets from the previous image to the current one
+type Refresh struct {
+	// Full is set if the whole display has to be refreshed with the complete image
+	Full    bool     `json:"full"`
+	Regions []Region `json:"regions"`
+	// Version of the image the refresh leads to and BaseVersion of the image the regions
+	// have to be applied to. Both are set when the image is published.
+	Version     string `json:"version"`
+	BaseVersion string `json:"base_version,omitempty"`
+}
+
+// Manifest returns a copy of the refresh without the data of the regions
+func (r Refresh) Manifest() Refresh {
+	regions := make([]Region, len(r.Regions))
+	for i, region := range r.Regions {
+		regions[i] = Region{X: region.X, Y: region.Y, Width: region.Width, Height: region.Height}
+	}
+	r.Regions = regions
+	return r
+}
+
+// updateRefresh compares the packed planes of a new image to the previous ones and decides
+// whether the display can be updated partially.
+func (i *ImageProcessor) updateRefresh(data []byte, accent []byte) {
+	config := i.imageConfig.PartialRefresh
+	defer func() {
+		i.previousData = data
+		i.previousAccent = accent
+	}()
+	if !config.Enabled {
+		return
+	}
+
+	every := config.FullRefreshEvery
+	if every == 0 {
+		every = defaultFullRefreshEvery
+	}
+	full := i.previousData == nil || len(i.previousData) != len(data) ||
+		(i.previousAccent == nil) != (accent == nil)
+
+	lines, lineLength := i.imageConfig.Packing.lines(i.imageConfig.Width, i.imageConfig.Height)
+	stride := i.imageConfig.Packing.stride(i.imageConfig.Width, i.imageConfig.Height, i.bitsPerPixel)
+	var rects []image.Rectangle
+	if !full {
+		rects = dirtyRects([][]byte{i.previousData, i.previousAccent}, [][]byte{data, accent}, lines, stride)
+		area := 0
+		for _, r := range rects {
+			area += r.Dx() * r.Dy()
+		}
+		// Unchanged images don't count towards the forced full refresh
+		full = len(rects) > 0 && i.partialRefreshes >= every ||
+			len(rects) > maxRegions || float64(area) > maxPartialShare*float64(lines*stride)
+	}
+
+	if full {
+		i.refresh = &Refresh{Full: true, Regions: []Region{}}
+		i.partialRefreshes = 0
+		return
+	}
+
+	i.refresh = &Refresh{Regions: []Region{}}
+	if len(rects) == 0 {
+		return
+	}
+	i.partialRefreshes++
+	pixelsPerByte := 8 / i.bitsPerPixel
+	for _, r := range rects {
+		// Convert from bytes and lines to pixels
+		start := r.Min.X * pixelsPerByte
+		length := r.Dx() * pixelsPerByte
+		if start+length > lineLength {
+			length = lineLength - start
+		}
+		region := Region{X: start, Y: r.Min.Y, Width: length, Height: r.Dy()}
+		if i.imageConfig.Packing.ColumnMajor {
+			region = Region{X: r.Min.Y, Y: start, Width: r.Dy(), Height: length}
+		}
+		region.Data = cut(data, stride, r)
+		if accent != nil {
+			region.Accent = cut(accent, stride, r)
+		}
+		i.refresh.Regions = append(i.refresh.Regions, region)
+	}
+}
+
+// dirtyRects returns the rectangles in which the planes differ. X of the rectangles
+// counts bytes within a line and Y counts lines.
+func dirtyRects(previous [][]byte, current [][]byte, lines int, stride int) []image.Rectangle {
+	changed := func(l int, b int) bool {
+		for p := range current {
+			if current[p] != nil && previous[p][l*stride+b] != current[p][l*stride+b] {
+				return true
+			}
+		}
+		return false
+	}
+	lineChanged := func(l int) bool {
+		for b := 0; b < stride; b++ {
+			if changed(l, b) {
+				return true
+			}
+		}
+		return false
+	}
+
+	rects := []image.Rectangle{}
+	for _, band := range spans(lines, mergeLines, lineChanged) {
+		// Split each band of changed lines into columns of changed bytes
+		columns := spans(stride, mergeBytes, func(b int) bool {
+			for l := band[0]; l < band[1]; l++ {
+				if changed(l, b) {
+					return true
+				}
+			}
+			return false
+		})
+		for _, column := range columns {
+			// Shrink the band to the lines that changed within the column
+			first, last := band[1], band[0]
+			for l := band[0]; l < band[1]; l++ {
+				for b := column[0]; b < column[1]; b++ {
+					if changed(l, b) {
+						if l < first {
+							first = l
+						}
+						last = l
+						break
+					}
+				}
+			}
+			rects = append(rects, image.Rect(column[0], first, column[1], last+1))
+		}
+	}
+	return rects
+}
+
+// spans returns the ranges [start, end) of indices below n for which set is true.
+// Ranges separated by at most gap indices are merged.
+func spans(n int, gap int, set func(int) bool) [][2]int {
+	result := [][2]int{}
+	for i := 0; i < n; i++ {
+		if !set(i) {
+			continue
+		}
+		if len(result) > 0 && i-result[len(result)-1][1] <= gap {
+			result[len(result)-1][1] = i + 1
+		} else {
+			result = append(result, [2]int{i, i + 1})
+		}
+	}
+	return result
+}
+
+// cut copies the bytes within r out of a plane
+func cut(plane []byte, stride int, r image.Rectangle) []byte {
+	data := make([]byte, 0, r.Dx()*r.Dy())
+	for l := r.Min.Y; l < r.Max.Y; l++ {
+		data = append(data, plane[l*stride+r.Min.X:l*stride+r.Max.X]...)
+	}
+	return data
+}
+
+// ResetRefresh makes the next image a full refresh, e.g. because the current one
+// didn't reach all displays.
+func (i *ImageProcessor) ResetRefresh() {
+	i.previousData = nil
+	i.previousAccent = nil
+}
+
+// Refresh describes how to update the display to the current image. It is nil if
+// partial refresh is disabled or no image was rendered yet.
+func (i *ImageProcessor) Refresh() *Refresh {
+	return i.refresh
+}
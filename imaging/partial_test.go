@@ -0,0 +1,117 @@
+package imaging
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newPartialProcessor(packing Packing, every int) *ImageProcessor {
+	return &ImageProcessor{
+		imageConfig: &ImageConfig{
+			Width:          32,
+			Height:         16,
+			Packing:        packing,
+			PartialRefresh: PartialRefreshConfig{Enabled: true, FullRefreshEvery: every},
+		},
+		bitsPerPixel: 1,
+	}
+}
+
+// frame returns a 32x16 1bpp buffer with the given bytes set to 0x0f
+func frame(changed ...int) []byte {
+	data := make([]byte, 64)
+	for _, c := range changed {
+		data[c] = 0x0f
+	}
+	return data
+}
+
+func TestPartialRefresh(t *testing.T) {
+	i := newPartialProcessor(Packing{}, 2)
+
+	i.updateRefresh(frame(), nil)
+	if !i.Refresh().Full {
+		t.Error("The first image requires a full refresh")
+	}
+
+	// Byte 1 of line 3
+	i.updateRefresh(frame(13), nil)
+	refresh := i.Refresh()
+	if refresh.Full || len(refresh.Regions) != 1 {
+		t.Fatalf("Expected one region, got %+v", refresh)
+	}
+	region := refresh.Regions[0]
+	if region.X != 8 || region.Y != 3 || region.Width != 8 || region.Height != 1 || !bytes.Equal(region.Data, []byte{0x0f}) {
+		t.Errorf("Unexpected region %+v", region)
+	}
+
+	// Lines 0 and 15 are too far apart to be merged
+	i.updateRefresh(frame(13, 0, 63), nil)
+	if refresh := i.Refresh(); refresh.Full || len(refresh.Regions) != 2 {
+		t.Fatalf("Expected two regions, got %+v", refresh)
+	}
+
+	i.updateRefresh(frame(13, 0, 63), nil)
+	if refresh := i.Refresh(); refresh.Full || len(refresh.Regions) != 0 {
+		t.Errorf("Expected no regions for an unchanged image, got %+v", refresh)
+	}
+
+	i.updateRefresh(frame(13), nil)
+	if !i.Refresh().Full {
+		t.Error("Expected a full refresh after two partial ones")
+	}
+
+	i.updateRefresh(frame(12), nil)
+	if i.Refresh().Full {
+		t.Error("Expected a partial refresh after a full one")
+	}
+
+	i.ResetRefresh()
+	i.updateRefresh(frame(12), nil)
+	if !i.Refresh().Full {
+		t.Error("Expected a full refresh after a reset")
+	}
+
+	all := []int{}
+	for b := 0; b < 64; b++ {
+		all = append(all, b)
+	}
+	i.updateRefresh(frame(all...), nil)
+	if !i.Refresh().Full {
+		t.Error("Expected a full refresh if most of the image changed")
+	}
+}
+
+func TestPartialRefreshColumnMajor(t *testing.T) {
+	i := newPartialProcessor(Packing{ColumnMajor: true}, 0)
+	i.updateRefresh(frame(), frame())
+
+	// Columns have 2 bytes, so this is the second byte of column 5
+	i.updateRefresh(frame(11), frame())
+	refresh := i.Refresh()
+	if refresh.Full || len(refresh.Regions) != 1 {
+		t.Fatalf("Expected one region, got %+v", refresh)
+	}
+	region := refresh.Regions[0]
+	if region.X != 5 || region.Y != 8 || region.Width != 1 || region.Height != 8 {
+		t.Errorf("Unexpected region %+v", region)
+	}
+	if !bytes.Equal(region.Accent, []byte{0}) {
+		t.Errorf("Unexpected accent %x", region.Accent)
+	}
+
+	manifest := refresh.Manifest()
+	if manifest.Regions[0].Data != nil || manifest.Regions[0].X != 5 || refresh.Regions[0].Data == nil {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+}
+
+func TestPartialRefreshDisabled(t *testing.T) {
+	i := newPartialProcessor(Packing{}, 0)
+	i.imageConfig.PartialRefresh.Enabled = false
+	i.updateRefresh(frame(), nil)
+	i.updateRefresh(frame(1), nil)
+	if i.Refresh() != nil {
+		t.Error("No refresh should be computed if partial refresh is disabled")
+	}
+}
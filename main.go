@@ -1,20 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"html/template"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/dschanoeh/what-to-wear/devices"
 	"github.com/dschanoeh/what-to-wear/evaluator"
 	"github.com/dschanoeh/what-to-wear/imaging"
 	"github.com/dschanoeh/what-to-wear/mqtt"
 	"github.com/dschanoeh/what-to-wear/owm_handler"
+	"github.com/dschanoeh/what-to-wear/runner"
 	"github.com/dschanoeh/what-to-wear/server"
+	"github.com/dschanoeh/what-to-wear/status"
 	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -22,6 +27,10 @@ import (
 
 const (
 	notificationTimeDelay = 5 + (imaging.VirtualTimeBudget / 1000)
+	// Time running updates get to finish during shutdown before they are aborted
+	updateShutdownTimeout = 30 * time.Second
+	// Time in-flight HTTP requests get to finish during shutdown
+	serverShutdownTimeout = 10 * time.Second
 )
 
 var (
@@ -30,59 +39,47 @@ var (
 	date    = "unknown"
 	builtBy = "unknown"
 
-	config         = Config{}
-	cronScheduler  = cron.New()
-	webServer      *server.Server
-	imageProcessor *imaging.ImageProcessor
-	mqttClient     *mqtt.MQTTClient
+	config          = Config{}
+	cronScheduler   *cron.Cron
+	webServer       *server.Server
+	registry        *devices.Registry
+	profiles        map[string][]evaluator.Message
+	imageProcessors = map[string]*imaging.ImageProcessor{}
+	mqttClient      *mqtt.MQTTClient
+	statusTracker   = status.NewTracker(status.Provider, status.Evaluator, status.Imaging, status.MQTT)
+
+	// runContext is cancelled to abort running updates during shutdown
+	runContext, cancelRuns = context.WithCancel(context.Background())
+	runningUpdates         sync.WaitGroup
+	updateCoordinator      = runner.New()
+	scheduledRunPolicy     runner.Policy
+
+	// shuttingDown is set when shutdown begins so no further refreshes are added to runningUpdates
+	shuttingDown      bool
+	shuttingDownMutex sync.Mutex
 )
 
 type Config struct {
 	OpenWeatherMap owm_handler.OpenWeatherMapConfig `yaml:"open_weather_map"`
 	Messages       []evaluator.Message              `yaml:"messages"`
+	Profiles       map[string][]evaluator.Message   `yaml:"profiles"`
+	Devices        []devices.DeviceConfig           `yaml:"devices"`
 	ServerConfig   server.ServerConfig              `yaml:"server"`
 	CronExpression string                           `yaml:"cron_expression"`
 	ImageConfig    imaging.ImageConfig              `yaml:"imaging"`
 	MQTTConfig     mqtt.MQTTConfig                  `yaml:"mqtt"`
+	// CronJobWrappers are applied to the scheduled job (recover, skip_if_still_running, delay_if_still_running)
+	CronJobWrappers []string `yaml:"cron_job_wrappers"`
+	// FetchSchedule and EvaluateSchedule allow fetching weather data and evaluating messages at different intervals
+	FetchSchedule    string `yaml:"fetch_schedule"`
+	EvaluateSchedule string `yaml:"evaluate_schedule"`
+	// UpdateOverlap determines what happens if a scheduled update is due while another one is running (skip or queue)
+	UpdateOverlap string `yaml:"update_overlap"`
 }
 
 func main() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan,
-		syscall.SIGHUP,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGQUIT)
-
-	go func() {
-		for {
-			s := <-sigChan
-			switch s {
-			case syscall.SIGHUP:
-				log.Info("SIGHUP")
-				cleanup()
-				os.Exit(0)
-
-			case syscall.SIGINT:
-				log.Info("SIGINT")
-				cleanup()
-				os.Exit(0)
-
-			case syscall.SIGTERM:
-				log.Info("SIGTERM")
-				cleanup()
-				os.Exit(0)
-
-			case syscall.SIGQUIT:
-				log.Info("SIGQUIT")
-				cleanup()
-				os.Exit(0)
-
-			default:
-				log.Warn("Received unknown signal")
-			}
-		}
-	}()
+	ctx, stop := context.WithCancel(context.Background())
+	go handleSignals(stop)
 
 	var verbose = flag.Bool("verbose", false, "Turns on verbose information on the update process. Otherwise, only errors cause output.")
 	var debug = flag.Bool("debug", false, "Turns on debug information")
@@ -116,98 +113,260 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = evaluator.Compile(&config.Messages)
-	if err != nil {
-		log.Error("Could not compile messages: ", err)
-		os.Exit(1)
+	profiles = buildProfiles(&config)
+	for name, messages := range profiles {
+		err = evaluator.Compile(&messages)
+		if err != nil {
+			log.Errorf("Could not compile messages of profile %s: %s", name, err)
+			os.Exit(1)
+		}
 	}
-	webServer = server.New(config.ServerConfig)
-	imageProcessor, err = imaging.New(&config.ImageConfig)
+
+	defaultLocation := devices.Location{Latitude: config.OpenWeatherMap.Latitude, Longitude: config.OpenWeatherMap.Longitude}
+	registry, err = devices.New(config.Devices, defaultLocation, config.MQTTConfig.BaseTopic)
 	if err != nil {
-		log.Error("Error creating image processor: ", err)
+		log.Error("Could not set up devices: ", err)
 		os.Exit(1)
 	}
-	defer imageProcessor.Close()
+	for _, d := range registry.Devices() {
+		if _, ok := profiles[d.Config.Profile]; !ok {
+			log.Errorf("Device %s uses unknown profile %s", d.Config.Name, d.Config.Profile)
+			os.Exit(1)
+		}
+	}
+
+	webServer = server.New(config.ServerConfig, registry, currentStatus)
+	webServer.OnRefresh(func() runner.Result { return refresh("HTTP") })
+	for _, v := range registry.Variants() {
+		imageConfig := config.ImageConfig
+		imageConfig.PixelFormat = v.PixelFormat
+		imageConfig.ScrapeURL, err = variantScrapeURL(config.ImageConfig.ScrapeURL, v.ID)
+		if err != nil {
+			log.Error("Invalid scrape URL: ", err)
+			os.Exit(1)
+		}
+		imageProcessor, err := imaging.New(&imageConfig)
+		if err != nil {
+			log.Error("Error creating image processor: ", err)
+			os.Exit(1)
+		}
+		imageProcessors[v.ID] = imageProcessor
+	}
 	mqttClient, err = mqtt.New(&config.MQTTConfig)
 	if err != nil {
 		log.Error("Error creating MQTT client: ", err)
 		os.Exit(1)
 	}
-	mqttClient.PostImageURL("http://" + config.ServerConfig.Listen + "/eInkImage")
+	mqttClient.PostImageURL(config.MQTTConfig.BaseTopic, imageURL(nil))
+	err = mqttClient.OnRefresh(func() interface{} { return refresh("MQTT") })
+	if err != nil {
+		log.Error("Could not subscribe to refresh commands: ", err)
+	}
 
 	// Schedule future periodic update calls
-	_, err = cronScheduler.AddFunc(config.CronExpression, updateData)
+	scheduledRunPolicy, err = runner.ParsePolicy(config.UpdateOverlap)
+	if err != nil {
+		log.Error("Invalid update_overlap: ", err)
+		os.Exit(1)
+	}
+	wrappers, err := cronJobWrappers(config.CronJobWrappers)
+	if err != nil {
+		log.Error("Invalid cron_job_wrappers: ", err)
+		os.Exit(1)
+	}
+	cronScheduler = cron.New(cron.WithChain(wrappers...))
+	err = scheduleJobs(cronScheduler, &config)
 	if err != nil {
 		log.Error("Was not able to schedule periodic execution: ", err)
 		os.Exit(1)
 	}
 	cronScheduler.Start()
 
-	// Update once so data is available to be served
-	go updateData()
+	// Update once so data is available to be served. Scheduled updates are
+	// tracked by the scheduler, this one has to be tracked separately.
+	runningUpdates.Add(1)
+	go func() {
+		defer runningUpdates.Done()
+		scheduledRun(jobUpdate, updateData, "startup")
+	}()
 
 	// Start computing and publishing update times
-	go publishNextUpdateTime()
+	go publishNextUpdateTime(ctx)
+
+	// Now let's serve until we're asked to stop or the server fails
+	serveErrors := make(chan error, 1)
+	go func() {
+		serveErrors <- webServer.Serve()
+	}()
 
-	// Now let's serve
-	webServer.Serve()
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+	case err := <-serveErrors:
+		log.Error("Server stopped: ", err)
+		exitCode = 1
+	}
+	shutdown()
+	os.Exit(exitCode)
 }
 
-func cleanup() {
-	log.Info("Cleaning up...")
-	cronScheduler.Stop()
-	imageProcessor.Close()
-	mqttClient.Close()
-	webServer.Close()
+// handleSignals reloads the TLS certificate on SIGHUP and calls stop on all
+// signals that should terminate the process.
+func handleSignals(stop context.CancelFunc) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan,
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT)
+
+	for {
+		s := <-sigChan
+		switch s {
+		case syscall.SIGHUP:
+			log.Info("SIGHUP")
+			if webServer != nil {
+				err := webServer.ReloadCertificate()
+				if err != nil {
+					log.Error("Could not reload TLS certificate: ", err)
+				}
+			}
+
+		case syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
+			log.Info(s)
+			stop()
+
+		default:
+			log.Warn("Received unknown signal")
+		}
+	}
 }
 
-func updateData() {
-	log.Info("Updating data...")
-	data, report, err := owm_handler.GetData(config.OpenWeatherMap)
-	if err != nil {
-		log.Error("Didn't receive updated information. Skipping update: ", err)
-		return
+// shutdown stops scheduling, waits for running updates, drains HTTP connections,
+// and disconnects from the MQTT broker.
+func shutdown() {
+	log.Info("Shutting down...")
+	shuttingDownMutex.Lock()
+	shuttingDown = true
+	shuttingDownMutex.Unlock()
+	cronDone := cronScheduler.Stop()
+
+	// Give running updates time to finish and abort them (including Chrome) otherwise
+	updatesDone := make(chan struct{})
+	go func() {
+		<-cronDone.Done()
+		runningUpdates.Wait()
+		close(updatesDone)
+	}()
+	select {
+	case <-updatesDone:
+	case <-time.After(updateShutdownTimeout):
+		log.Warn("Running update didn't finish in time, aborting it...")
+		cancelRuns()
+		<-updatesDone
 	}
-	log.Debugf("Evaluation data: %+v\n", data)
-	log.Infof("Weather report: %+v\n", report)
+	cancelRuns()
 
-	messages := evaluator.Evaluate(data, &config.Messages)
+	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	err := webServer.Shutdown(ctx)
+	if err != nil {
+		log.Error("Could not shut down server gracefully: ", err)
+	}
 
-	// Convert to HTML templates to allow HTML tags to pass through
-	templateMessages := make([]template.HTML, len(messages))
-	for i := range messages {
-		templateMessages[i] = template.HTML(messages[i])
+	mqttClient.Close()
+	for _, imageProcessor := range imageProcessors {
+		imageProcessor.Close()
 	}
+	log.Info("Shutdown complete")
+}
 
-	currentDateString := time.Now().Format(time.RFC850)
-	content := server.Content{
-		Messages:        templateMessages,
-		Version:         version,
-		CreationTime:    currentDateString,
-		Location:        fmt.Sprintf("(%.3f, %.3f)", config.OpenWeatherMap.Latitude, config.OpenWeatherMap.Longitude),
-		WeatherIconURL:  report.WeatherIconURL,
-		FontAwesomeIcon: report.FontAwesomeIcon,
-		WeatherReport:   fmt.Sprintf("%.0f°C", data.Current.Temperature) + " - " + report.Description,
+// buildProfiles returns all message profiles. The top-level messages form the default profile.
+func buildProfiles(config *Config) map[string][]evaluator.Message {
+	profiles := map[string][]evaluator.Message{}
+	for name, messages := range config.Profiles {
+		profiles[name] = messages
 	}
+	profiles[devices.DefaultProfile] = config.Messages
+	return profiles
+}
 
-	webServer.UpdateData(&content)
-	imageProcessor.Update()
-	err = mqttClient.Post(imageProcessor.GetImageAsBinary(), currentDateString)
-	if err != nil {
-		log.Error("Was not able to post image to MQTT broker: ", err)
+// variantScrapeURL returns the URL Chrome has to render for a specific variant.
+// Without a scrape URL, the in-memory page is rendered instead.
+func variantScrapeURL(scrapeURL string, variantID string) (string, error) {
+	if scrapeURL == "" {
+		return "", nil
 	}
-	webServer.UpdateImage(imageProcessor.GetImageAsBinary())
-	err = mqttClient.PostImageURL("http://" + config.ServerConfig.Listen + "/eInkImage")
+	u, err := url.Parse(scrapeURL)
 	if err != nil {
-		log.Error("Was not able to post image URL to MQTT broker: ", err)
+		return "", err
 	}
+	if variantID == devices.DefaultVariantID {
+		return scrapeURL, nil
+	}
+	query := u.Query()
+	query.Set("variant", variantID)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// imageURL returns the URL a device can fetch its image from. For nil, the URL
+// of the default variant is returned.
+func imageURL(d *devices.Device) string {
+	scheme := "http://"
+	if config.ServerConfig.TLSEnabled() {
+		scheme = "https://"
+	}
+	u := scheme + config.ServerConfig.Listen + "/eInkImage"
+	if d != nil {
+		u += "?device=" + url.QueryEscape(d.Config.Name)
+	}
+	return u
+}
+
+// currentStatus collects the application state for the status endpoints
+func currentStatus() server.Status {
+	s := server.Status{
+		Subsystems: statusTracker.Subsystems(),
+		DataTime:   statusTracker.Get(status.Provider).LastSuccess,
+		Build: server.BuildInfo{
+			Version: version,
+			Commit:  commit,
+			Date:    date,
+			BuiltBy: builtBy,
+		},
+	}
+	if mqttClient != nil {
+		s.MQTTConnected = mqttClient.IsConnected()
+	}
+	if cronScheduler == nil {
+		return s
+	}
+	s.NextRun = nextRun()
+	return s
 }
 
-func publishNextUpdateTime() {
+// nextRun returns the time of the next scheduled job or the zero time if nothing is scheduled
+func nextRun() time.Time {
+	next := time.Time{}
+	for _, e := range cronScheduler.Entries() {
+		if e.Next.IsZero() {
+			continue
+		}
+		if next.IsZero() || e.Next.Before(next) {
+			next = e.Next
+		}
+	}
+	return next
+}
+
+func publishNextUpdateTime(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
 	for {
 		tillNextUpdate := 0
-		if len(cronScheduler.Entries()) > 0 {
-			nextTrigger := cronScheduler.Entries()[0].Next
+		if nextTrigger := nextRun(); !nextTrigger.IsZero() {
 			delta := time.Until(nextTrigger)
 			tillNextUpdate = int(delta.Seconds())
 			// We'll lie a little bit to make sure the image is already rendered when the client checks in
@@ -215,12 +374,22 @@ func publishNextUpdateTime() {
 		} else {
 			log.Warn("Scheduler doesn't seem to have any entries...")
 		}
-		err := mqttClient.RefreshUpdateTime(tillNextUpdate)
-		if err != nil {
-			log.Error("Was not able to post time to update to MQTT broker: ", err)
+		topics := []string{config.MQTTConfig.BaseTopic}
+		for _, d := range registry.Devices() {
+			topics = append(topics, d.Config.MQTTTopic)
+		}
+		for _, topic := range topics {
+			err := mqttClient.RefreshUpdateTime(topic, tillNextUpdate)
+			if err != nil {
+				log.Error("Was not able to post time to update to MQTT broker: ", err)
+			}
 		}
 
-		time.Sleep(5 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
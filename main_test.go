@@ -1,8 +1,38 @@
 package main
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/robfig/cron/v3"
+)
 
 func TestLoadConfig(t *testing.T) {
 	c := Config{}
 	loadConfig("examples/config.yml", &c)
 }
+
+func TestScheduleJobs(t *testing.T) {
+	err := scheduleJobs(cron.New(), &Config{})
+	if err == nil {
+		t.Error("Expected an error without any schedule")
+	}
+
+	scheduler := cron.New()
+	err = scheduleJobs(scheduler, &Config{FetchSchedule: "*/30 * * * *", EvaluateSchedule: "*/5 * * * *"})
+	if err != nil {
+		t.Fatal("An error was returned: ", err)
+	}
+	if len(scheduler.Entries()) != 2 {
+		t.Error("Expected two scheduled jobs, got ", len(scheduler.Entries()))
+	}
+}
+
+func TestRefreshDuringShutdown(t *testing.T) {
+	shuttingDown = true
+	defer func() { shuttingDown = false }()
+
+	result := refresh("test")
+	if result.Success || len(result.Errors) != 1 || result.ID != 0 {
+		t.Errorf("The refresh should have been rejected, got %+v", result)
+	}
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "what_to_wear"
+
+// Reasons for screenshot retries
+const (
+	RetryReasonError    = "error"
+	RetryReasonAllWhite = "all_white"
+)
+
+var (
+	ProviderFetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "provider_fetch_duration_seconds",
+		Help:      "Duration of weather data requests.",
+	})
+	ProviderFetchErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_fetch_errors_total",
+		Help:      "Number of failed weather data requests.",
+	})
+	RenderDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "render_duration_seconds",
+		Help:      "Duration of render runs.",
+		Buckets:   []float64{0.5, 1, 2, 3, 5, 7.5, 10, 15},
+	})
+	RenderRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "render_retries_total",
+		Help:      "Number of failed screenshot attempts that caused a retry.",
+	}, []string{"reason"})
+	EvaluationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "evaluation_errors_total",
+		Help:      "Number of messages that couldn't be evaluated.",
+	})
+	MQTTPublishFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_publish_failures_total",
+		Help:      "Number of failed MQTT publish operations.",
+	})
+	MQTTConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connected",
+		Help:      "1 if the MQTT client is connected to the broker, 0 otherwise.",
+	})
+	ImageBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "image_bytes",
+		Help:      "Size of the current packed image data.",
+	}, []string{"variant"})
+
+	dataTimeMutex sync.Mutex
+	dataTime      time.Time
+	dataAge       = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "data_age_seconds",
+		Help:      "Age of the current weather data. -1 if no data was received yet.",
+	}, func() float64 {
+		dataTimeMutex.Lock()
+		defer dataTimeMutex.Unlock()
+		if dataTime.IsZero() {
+			return -1
+		}
+		return time.Since(dataTime).Seconds()
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ProviderFetchDuration,
+		ProviderFetchErrors,
+		RenderDuration,
+		RenderRetries,
+		EvaluationErrors,
+		MQTTPublishFailures,
+		MQTTConnected,
+		ImageBytes,
+		dataAge,
+	)
+}
+
+// SetDataTime sets the time the current weather data was received
+func SetDataTime(t time.Time) {
+	dataTimeMutex.Lock()
+	defer dataTimeMutex.Unlock()
+	dataTime = t
+}
+
+// Handler returns the handler serving all metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// ChunkHeaderSize is the number of bytes preceding the data of every chunk
+const ChunkHeaderSize = 12
+
+// ChunkManifest describes the planes of an image that were split into chunks. It is published after the chunks.
+type ChunkManifest struct {
+	// FrameID is contained in all chunks of the image
+	FrameID uint32 `json:"frame_id"`
+	// ChunkSize is the maximum number of payload bytes per chunk. The last chunk of a plane may be shorter.
+	ChunkSize int         `json:"chunk_size"`
+	Data      PlaneChunks `json:"data"`
+	// Accent is only set for tri-color displays
+	Accent *PlaneChunks `json:"accent,omitempty"`
+}
+
+// PlaneChunks describes one plane that was split into chunks
+type PlaneChunks struct {
+	// Size of the complete plane in bytes
+	Size      int `json:"size"`
+	NumChunks int `json:"num_chunks"`
+	// CRC32 (IEEE) of the complete plane
+	CRC32 uint32 `json:"crc32"`
+}
+
+// splitChunks splits the payload into chunks of at most chunkSize bytes. Every chunk starts
+// with a header of the frame ID (4 bytes), the chunk index (2 bytes), the number of chunks
+// (2 bytes), and the CRC32 of the chunk's data (4 bytes), all big-endian.
+func splitChunks(payload []byte, chunkSize int, frameID uint32) ([][]byte, PlaneChunks, error) {
+	manifest := PlaneChunks{
+		Size:      len(payload),
+		NumChunks: (len(payload) + chunkSize - 1) / chunkSize,
+		CRC32:     crc32.ChecksumIEEE(payload),
+	}
+	if manifest.NumChunks > math.MaxUint16 {
+		return nil, manifest, fmt.Errorf("%d bytes need too many chunks of %d bytes", len(payload), chunkSize)
+	}
+
+	chunks := [][]byte{}
+	for i := 0; i < manifest.NumChunks; i++ {
+		end := chunkSize * (i + 1)
+		if end > len(payload) {
+			end = len(payload)
+		}
+		data := payload[chunkSize*i : end]
+
+		chunk := make([]byte, ChunkHeaderSize+len(data))
+		binary.BigEndian.PutUint32(chunk[0:], frameID)
+		binary.BigEndian.PutUint16(chunk[4:], uint16(i))
+		binary.BigEndian.PutUint16(chunk[6:], uint16(manifest.NumChunks))
+		binary.BigEndian.PutUint32(chunk[8:], crc32.ChecksumIEEE(data))
+		copy(chunk[ChunkHeaderSize:], data)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, manifest, nil
+}
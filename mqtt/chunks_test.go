@@ -0,0 +1,144 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeClient records the payloads published to each topic. Publishing fails with err if it is set.
+type fakeClient struct {
+	mqtt.Client
+	messages map[string][]byte
+	err      error
+}
+
+func (f *fakeClient) IsConnected() bool {
+	return true
+}
+
+func (f *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+
+func (f *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.messages[topic] = payload.([]byte)
+	return &fakeToken{err: f.err}
+}
+
+func TestSplitChunks(t *testing.T) {
+	payload := make([]byte, 25)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	tests := []struct {
+		chunkSize int
+		sizes     []int
+	}{
+		{10, []int{10, 10, 5}},
+		{5, []int{5, 5, 5, 5, 5}},
+		{100, []int{25}},
+	}
+	for _, test := range tests {
+		chunks, manifest, err := splitChunks(payload, test.chunkSize, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.NumChunks != len(test.sizes) || manifest.Size != 25 || manifest.CRC32 != crc32.ChecksumIEEE(payload) {
+			t.Errorf("Unexpected manifest %+v", manifest)
+		}
+		if len(chunks) != len(test.sizes) {
+			t.Fatalf("Expected %d chunks, got %d", len(test.sizes), len(chunks))
+		}
+
+		joined := []byte{}
+		for i, chunk := range chunks {
+			data := chunk[ChunkHeaderSize:]
+			if len(data) != test.sizes[i] {
+				t.Errorf("Chunk %d has %d bytes instead of %d", i, len(data), test.sizes[i])
+			}
+			if binary.BigEndian.Uint32(chunk) != 42 || binary.BigEndian.Uint16(chunk[4:]) != uint16(i) ||
+				binary.BigEndian.Uint16(chunk[6:]) != uint16(len(test.sizes)) || binary.BigEndian.Uint32(chunk[8:]) != crc32.ChecksumIEEE(data) {
+				t.Errorf("Unexpected header %x", chunk[:ChunkHeaderSize])
+			}
+			joined = append(joined, data...)
+		}
+		if !bytes.Equal(joined, payload) {
+			t.Errorf("The chunks don't add up to the payload: %x", joined)
+		}
+	}
+}
+
+func TestSplitChunksLimit(t *testing.T) {
+	if _, _, err := splitChunks(make([]byte, 70000), 1, 1); err == nil {
+		t.Error("More than 65535 chunks should be rejected")
+	}
+}
+
+func TestPostChunks(t *testing.T) {
+	client := &fakeClient{messages: map[string][]byte{}}
+	c := MQTTClient{config: &MQTTConfig{ChunkSize: 4}, client: client}
+
+	if err := c.Post(log.NewEntry(log.StandardLogger()), "a", 7, make([]byte, 10), make([]byte, 3), "now", true); err != nil {
+		t.Fatal(err)
+	}
+	var manifest ChunkManifest
+	if err := json.Unmarshal(client.messages["a/manifest"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.FrameID != 7 || manifest.Data.NumChunks != 3 || manifest.Accent == nil || manifest.Accent.NumChunks != 1 {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+	for _, topic := range []string{"a/chunks/0", "a/chunks/2", "a/accent/chunks/0"} {
+		if chunk := client.messages[topic]; len(chunk) < ChunkHeaderSize || binary.BigEndian.Uint32(chunk) != 7 {
+			t.Errorf("Unexpected chunk %x on %s", chunk, topic)
+		}
+	}
+	if _, ok := client.messages["a/accent/manifest"]; ok {
+		t.Error("The accent plane shouldn't have a manifest of its own")
+	}
+
+	c.config.ChunkSize = 1
+	client.messages = map[string][]byte{}
+	if err := c.Post(log.NewEntry(log.StandardLogger()), "a", 8, make([]byte, 70000), nil, "now", true); err == nil {
+		t.Error("An error should be returned if the payload can't be split")
+	}
+	if len(client.messages) != 0 {
+		t.Errorf("Nothing should be published if the payload can't be split, got %d messages", len(client.messages))
+	}
+}
+
+func TestPostRegionChunks(t *testing.T) {
+	client := &fakeClient{messages: map[string][]byte{}}
+	c := MQTTClient{config: &MQTTConfig{ChunkSize: 4}, client: client}
+
+	if err := c.Post(log.NewEntry(log.StandardLogger()), "a", 9, make([]byte, 10), nil, "now", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.messages["a/manifest"]; ok {
+		t.Error("The image shouldn't be chunked for a partial refresh")
+	}
+
+	err := c.PostRegions(log.NewEntry(log.StandardLogger()), "a", 9, map[string]bool{"full": false}, [][]byte{make([]byte, 6)}, [][]byte{make([]byte, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ChunkManifest
+	if err := json.Unmarshal(client.messages["a/regions/0/manifest"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.FrameID != 9 || manifest.Data.NumChunks != 2 || manifest.Accent == nil || manifest.Accent.Size != 2 {
+		t.Errorf("Unexpected region manifest %+v", manifest)
+	}
+	for _, topic := range []string{"a/regions/0/data", "a/regions/0/chunks/1", "a/regions/0/accent/chunks/0", "a/refresh"} {
+		if _, ok := client.messages[topic]; !ok {
+			t.Errorf("Nothing was published to %s", topic)
+		}
+	}
+}
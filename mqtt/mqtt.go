@@ -1,37 +1,64 @@
 package mqtt
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dschanoeh/what-to-wear/compression"
+	"github.com/dschanoeh/what-to-wear/metrics"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	ConnectTimeout = time.Second * 60
+	// Time in ms to wait for outstanding work when disconnecting
+	disconnectQuiesce = 250
 )
 
 type MQTTConfig struct {
 	BrokerURL string `yaml:"broker_url"`
 	BaseTopic string `yaml:"base_topic"`
 	ChunkSize int    `yaml:"chunk_size"`
+	// Compression of the image data published to the base topic and the default
+	// for devices, see the compression package
+	Compression string `yaml:"compression"`
+	// QoS of all topics that aren't configured in Topics (default 0)
+	QoS byte `yaml:"qos"`
+	// Topics configures QoS and retain per topic, keyed by the topic below the base or device
+	// topic without indices, e.g. "data", "accent/chunks", or "regions/data"
+	Topics map[string]TopicConfig `yaml:"topics"`
+	// PublishTimeout is the maximum time to wait for the broker to accept the messages
+	// of an operation. 0 uses the default of 10s.
+	PublishTimeout time.Duration `yaml:"publish_timeout"`
 }
 
 type MQTTClient struct {
 	config  *MQTTConfig
 	client  mqtt.Client
 	options *mqtt.ClientOptions
+	// refreshHandler is set by OnRefresh and read by the connect handler on paho's goroutine
+	refreshHandler func() interface{}
+	refreshMutex   sync.Mutex
+	// frameID of the last image
+	frameID uint32
 }
 
 func New(config *MQTTConfig) (*MQTTClient, error) {
-	c := MQTTClient{config: config}
+	c, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
 
 	c.options = mqtt.NewClientOptions()
 	c.options.AddBroker(config.BrokerURL)
 	c.options.SetAutoReconnect(true)
+	c.options.SetOnConnectHandler(c.connectHandler)
 	c.options.SetConnectionLostHandler(connectionLostHandler)
 	c.options.SetReconnectingHandler(reconnectingHandler)
 	c.options.SetConnectTimeout(ConnectTimeout)
@@ -45,62 +72,276 @@ func New(config *MQTTConfig) (*MQTTClient, error) {
 	}
 	log.Info("MQTT connected")
 
-	return &c, nil
+	return c, nil
+}
+
+// NewWithClient publishes through an existing client, e.g. a fake one in tests, which
+// has to handle connecting itself.
+func NewWithClient(config *MQTTConfig, client mqtt.Client) (*MQTTClient, error) {
+	c, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+	return c, nil
+}
+
+func newClient(config *MQTTConfig) (*MQTTClient, error) {
+	if err := compression.Validate(config.Compression); err != nil {
+		return nil, err
+	}
+	if err := validateQoS(config); err != nil {
+		return nil, err
+	}
+	// Start with the current time so frame IDs keep increasing across restarts
+	return &MQTTClient{config: config, frameID: uint32(time.Now().Unix())}, nil
 }
 
 func reconnectingHandler(client mqtt.Client, options *mqtt.ClientOptions) {
 	log.Info("Attempting to reconnect to broker...")
 }
 
+func (c *MQTTClient) connectHandler(client mqtt.Client) {
+	metrics.MQTTConnected.Set(1)
+	// Subscriptions don't survive reconnects with a clean session
+	c.refreshMutex.Lock()
+	handler := c.refreshHandler
+	c.refreshMutex.Unlock()
+	if handler != nil {
+		if err := c.subscribeRefresh(handler); err != nil {
+			log.Error("Could not subscribe to refresh commands: ", err)
+		}
+	}
+}
+
 func connectionLostHandler(client mqtt.Client, reason error) {
 	log.Warn("MQTT broker connection lost: ", reason.Error())
+	metrics.MQTTConnected.Set(0)
+}
+
+// IsConnected returns true if the client is currently connected to the broker
+func (c *MQTTClient) IsConnected() bool {
+	return c.client.IsConnected()
+}
+
+// OnRefresh subscribes to <base_topic>/cmd/refresh. handler is called for every
+// message received there and its result is published as JSON to <base_topic>/cmd/refresh/result.
+// Retained commands are ignored, so a left over command doesn't trigger a refresh on every (re)connect.
+func (c *MQTTClient) OnRefresh(handler func() interface{}) error {
+	c.refreshMutex.Lock()
+	c.refreshHandler = handler
+	c.refreshMutex.Unlock()
+	return c.subscribeRefresh(handler)
 }
 
+func (c *MQTTClient) subscribeRefresh(handler func() interface{}) error {
+	topic := fmt.Sprintf("%s/%s", c.config.BaseTopic, "cmd/refresh")
+	token := c.client.Subscribe(topic, 1, func(client mqtt.Client, message mqtt.Message) {
+		if message.Retained() {
+			log.Warn("Ignoring retained refresh command on ", topic)
+			return
+		}
+		// Don't block the client while the refresh is running
+		go func() {
+			result, err := json.Marshal(handler())
+			if err != nil {
+				log.Error("Could not encode refresh result: ", err)
+				return
+			}
+			p, err := c.newPublisher()
+			if err == nil {
+				p.publish(c.config.BaseTopic, "cmd/refresh/result", false, result)
+				err = p.wait()
+			}
+			if err != nil {
+				log.Error("Could not publish refresh result: ", err)
+			}
+		}()
+	})
+	if !token.WaitTimeout(ConnectTimeout) {
+		return errors.New("timeout while subscribing to " + topic)
+	}
+	return token.Error()
+}
+
+// Close disconnects from the broker after giving outstanding messages time to be sent
 func (c *MQTTClient) Close() error {
-	c.client.Disconnect(100)
+	c.client.Disconnect(disconnectQuiesce)
+	metrics.MQTTConnected.Set(0)
+	log.Info("MQTT disconnected")
 	return nil
 }
 
-func (c *MQTTClient) Post(payload []byte, currentDateString string) error {
-	if !c.client.IsConnected() {
-		return errors.New("MQTT not connected")
+// NewFrameID returns the ID identifying the chunks of a new image. All planes and
+// topics the image is published to share it.
+func (c *MQTTClient) NewFrameID() uint32 {
+	return atomic.AddUint32(&c.frameID, 1)
+}
+
+// Post publishes the image payload and its generation time below the given base topic and
+// logs through the logger of the run.
+// The accent plane of tri-color displays is published below <baseTopic>/accent with the
+// same layout and is nil otherwise. The planes are only published in chunks if chunked is
+// set, partial refreshes only chunk their regions.
+func (c *MQTTClient) Post(logger *log.Entry, baseTopic string, frameID uint32, payload []byte, accent []byte, currentDateString string, chunked bool) error {
+	var chunks *chunkedImage
+	var err error
+	if chunked {
+		chunks, err = c.splitImage(frameID, payload, accent)
+		if err != nil {
+			return err
+		}
+	}
+	p, err := c.newPublisher()
+	if err != nil {
+		return err
+	}
+
+	logger.Debugf("Publishing %d bytes to %s/data", len(payload), baseTopic)
+	p.publish(baseTopic, "generationTime", true, []byte(currentDateString))
+	p.publish(baseTopic, "data", true, payload)
+	if accent != nil {
+		p.publish(baseTopic, "accent/data", true, accent)
 	}
+	c.postChunks(logger, p, baseTopic, "", chunks)
 
-	c.client.Publish(fmt.Sprintf("%s/%s", c.config.BaseTopic, "generationTime"), 0, true, []byte(currentDateString))
-	c.client.Publish(fmt.Sprintf("%s/%s", c.config.BaseTopic, "data"), 0, true, payload)
+	return p.wait()
+}
 
-	if c.config.ChunkSize != 0 {
-		if len(payload)%c.config.ChunkSize != 0 {
-			log.Error("Data length is no multiple of the chunk size. This is likely a configuration error. Not posting chunks.")
-		} else {
-			num := len(payload) / c.config.ChunkSize
-			c.client.Publish(fmt.Sprintf("%s/%s", c.config.BaseTopic, "numChunks"), 0, true, []byte(strconv.Itoa(num)))
-			for i := 0; i < num; i++ {
-				chunk := payload[c.config.ChunkSize*i : c.config.ChunkSize*i+c.config.ChunkSize-1]
-				c.client.Publish(fmt.Sprintf("%s/%s/%d", c.config.BaseTopic, "chunks", i), 0, true, chunk)
-			}
+// PostFormat publishes the description of the data format as JSON to <baseTopic>/format
+func (c *MQTTClient) PostFormat(baseTopic string, format interface{}) error {
+	p, err := c.newPublisher()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(format)
+	if err != nil {
+		return err
+	}
+	p.publish(baseTopic, "format", true, payload)
+
+	return p.wait()
+}
+
+// PostRegions publishes the regions of a partial refresh to <baseTopic>/regions/<n>/data and
+// <baseTopic>/regions/<n>/accent, chunked like the planes of Post below <baseTopic>/regions/<n>,
+// followed by the manifest describing them as JSON to <baseTopic>/refresh.
+func (c *MQTTClient) PostRegions(logger *log.Entry, baseTopic string, frameID uint32, manifest interface{}, data [][]byte, accent [][]byte) error {
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	chunks := make([]*chunkedImage, len(data))
+	for i := range data {
+		var regionAccent []byte
+		if accent != nil {
+			regionAccent = accent[i]
+		}
+		chunks[i], err = c.splitImage(frameID, data[i], regionAccent)
+		if err != nil {
+			return fmt.Errorf("region %d: %w", i, err)
 		}
 	}
+	p, err := c.newPublisher()
+	if err != nil {
+		return err
+	}
 
-	return nil
+	for i := range data {
+		prefix := fmt.Sprintf("regions/%d/", i)
+		p.publish(baseTopic, prefix+"data", true, data[i])
+		if accent != nil {
+			p.publish(baseTopic, prefix+"accent", true, accent[i])
+		}
+		c.postChunks(logger, p, baseTopic, prefix, chunks[i])
+	}
+	p.publish(baseTopic, "refresh", true, payload)
+
+	return p.wait()
+}
+
+// chunkedImage holds the planes of an image split into chunks
+type chunkedImage struct {
+	data     [][]byte
+	accent   [][]byte
+	manifest []byte
 }
 
-func (c *MQTTClient) PostImageURL(url string) error {
-	if !c.client.IsConnected() {
-		return errors.New("MQTT not connected")
+// splitImage splits the planes into chunks of ChunkSize. It returns nil if chunking is disabled.
+func (c *MQTTClient) splitImage(frameID uint32, data []byte, accent []byte) (*chunkedImage, error) {
+	if c.config.ChunkSize == 0 {
+		return nil, nil
+	}
+	chunked := chunkedImage{}
+	manifest := ChunkManifest{FrameID: frameID, ChunkSize: c.config.ChunkSize}
+	var err error
+	chunked.data, manifest.Data, err = splitChunks(data, c.config.ChunkSize, frameID)
+	if err != nil {
+		return nil, err
+	}
+	if accent != nil {
+		var planeChunks PlaneChunks
+		chunked.accent, planeChunks, err = splitChunks(accent, c.config.ChunkSize, frameID)
+		if err != nil {
+			return nil, fmt.Errorf("accent: %w", err)
+		}
+		manifest.Accent = &planeChunks
 	}
+	chunked.manifest, err = json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &chunked, nil
+}
 
-	c.client.Publish(fmt.Sprintf("%s/%s", c.config.BaseTopic, "rawImageURL"), 0, true, []byte(url))
+// postChunks publishes the chunks to <baseTopic>/<prefix>chunks and <baseTopic>/<prefix>accent/chunks,
+// followed by the manifest describing both planes
+func (c *MQTTClient) postChunks(logger *log.Entry, p *publisher, baseTopic string, prefix string, chunked *chunkedImage) {
+	if chunked == nil {
+		return
+	}
+	logger.Debugf("Publishing %d data and %d accent chunks to %s/%schunks", len(chunked.data), len(chunked.accent), baseTopic, prefix)
+	for i, chunk := range chunked.data {
+		p.publish(baseTopic, fmt.Sprintf("%schunks/%d", prefix, i), true, chunk)
+	}
+	for i, chunk := range chunked.accent {
+		p.publish(baseTopic, fmt.Sprintf("%saccent/chunks/%d", prefix, i), true, chunk)
+	}
+	p.publish(baseTopic, prefix+"manifest", true, chunked.manifest)
+}
 
-	return nil
+// PostHeartbeat tells clients listening below baseTopic that an update was
+// performed but the image didn't change.
+func (c *MQTTClient) PostHeartbeat(baseTopic string) error {
+	p, err := c.newPublisher()
+	if err != nil {
+		return err
+	}
+
+	p.publish(baseTopic, "heartbeat", false, []byte("unchanged"))
+
+	return p.wait()
 }
 
-func (c *MQTTClient) RefreshUpdateTime(tillNextUpdate int) error {
-	if !c.client.IsConnected() {
-		return errors.New("MQTT not connected")
+func (c *MQTTClient) PostImageURL(baseTopic string, url string) error {
+	p, err := c.newPublisher()
+	if err != nil {
+		return err
 	}
 
-	c.client.Publish(fmt.Sprintf("%s/%s", c.config.BaseTopic, "nextUpdateIn"), 0, true, []byte(strconv.Itoa(tillNextUpdate)))
+	p.publish(baseTopic, "rawImageURL", true, []byte(url))
 
-	return nil
+	return p.wait()
+}
+
+func (c *MQTTClient) RefreshUpdateTime(baseTopic string, tillNextUpdate int) error {
+	p, err := c.newPublisher()
+	if err != nil {
+		return err
+	}
+
+	p.publish(baseTopic, "nextUpdateIn", true, []byte(strconv.Itoa(tillNextUpdate)))
+
+	return p.wait()
 }
@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dschanoeh/what-to-wear/metrics"
+)
+
+// scrapeMetrics returns the values of all metrics without labels served by the metrics handler
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Unexpected status %d", rec.Code)
+	}
+
+	values := map[string]float64{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values
+}
+
+func TestPublishMetrics(t *testing.T) {
+	client := &fakeClient{messages: map[string][]byte{}, err: errors.New("connection lost")}
+	c := MQTTClient{config: &MQTTConfig{}, client: client}
+	c.connectHandler(client)
+	before := scrapeMetrics(t)
+
+	if err := c.PostHeartbeat("a"); err == nil {
+		t.Fatal("The failed publish should have been reported")
+	}
+	after := scrapeMetrics(t)
+	if after["what_to_wear_mqtt_publish_failures_total"] != before["what_to_wear_mqtt_publish_failures_total"]+1 {
+		t.Errorf("Expected one more publish failure, got %v before and %v after",
+			before["what_to_wear_mqtt_publish_failures_total"], after["what_to_wear_mqtt_publish_failures_total"])
+	}
+	if after["what_to_wear_mqtt_connected"] != 1 {
+		t.Errorf("Expected the client to be reported as connected, got %v", after["what_to_wear_mqtt_connected"])
+	}
+
+	connectionLostHandler(client, errors.New("connection lost"))
+	if connected := scrapeMetrics(t)["what_to_wear_mqtt_connected"]; connected != 0 {
+		t.Errorf("Expected the client to be reported as disconnected, got %v", connected)
+	}
+}
+
+// TestOnRefreshDuringReconnect detects unsynchronized access to the refresh handler when run with -race
+func TestOnRefreshDuringReconnect(t *testing.T) {
+	client := &fakeClient{messages: map[string][]byte{}}
+	c := MQTTClient{config: &MQTTConfig{BaseTopic: "a"}, client: client}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.connectHandler(client)
+		}
+	}()
+	if err := c.OnRefresh(func() interface{} { return nil }); err != nil {
+		t.Error(err)
+	}
+	<-done
+}
@@ -0,0 +1,134 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dschanoeh/what-to-wear/metrics"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultPublishTimeout is used if PublishTimeout isn't set
+const defaultPublishTimeout = 10 * time.Second
+
+// TopicConfig overrides how messages are published to a topic
+type TopicConfig struct {
+	QoS    *byte `yaml:"qos"`
+	Retain *bool `yaml:"retain"`
+}
+
+// PublishError is returned if messages couldn't be published
+type PublishError struct {
+	Errors []error
+}
+
+func (e *PublishError) Error() string {
+	if len(e.Errors) == 1 {
+		return "could not publish " + e.Errors[0].Error()
+	}
+	return fmt.Sprintf("could not publish %d messages, first error: %s", len(e.Errors), e.Errors[0])
+}
+
+// topicKey returns the key of a topic below the base topic in MQTTConfig.Topics,
+// which omits the indices of chunks and regions
+func topicKey(suffix string) string {
+	parts := []string{}
+	for _, part := range strings.Split(suffix, "/") {
+		if _, err := strconv.Atoi(part); err != nil {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// topicOptions returns the QoS and retain flag for a topic below the base topic
+func (c *MQTTClient) topicOptions(suffix string, retained bool) (byte, bool) {
+	qos := c.config.QoS
+	if t, ok := c.config.Topics[topicKey(suffix)]; ok {
+		if t.QoS != nil {
+			qos = *t.QoS
+		}
+		if t.Retain != nil {
+			retained = *t.Retain
+		}
+	}
+	return qos, retained
+}
+
+// validateQoS returns an error if a configured QoS level doesn't exist
+func validateQoS(config *MQTTConfig) error {
+	if config.QoS > 2 {
+		return fmt.Errorf("invalid QoS %d", config.QoS)
+	}
+	for key, t := range config.Topics {
+		if t.QoS != nil && *t.QoS > 2 {
+			return fmt.Errorf("invalid QoS %d for topic %s", *t.QoS, key)
+		}
+	}
+	return nil
+}
+
+// publisher publishes the messages of one operation and collects their tokens,
+// so their delivery can be awaited together
+type publisher struct {
+	c      *MQTTClient
+	topics []string
+	tokens []mqtt.Token
+}
+
+func (c *MQTTClient) newPublisher() (*publisher, error) {
+	if !c.client.IsConnected() {
+		metrics.MQTTPublishFailures.Inc()
+		return nil, errors.New("MQTT not connected")
+	}
+	return &publisher{c: c}, nil
+}
+
+// publish sends payload to <baseTopic>/<suffix>. retained is used unless the topic is configured otherwise.
+func (p *publisher) publish(baseTopic string, suffix string, retained bool, payload interface{}) {
+	qos, retained := p.c.topicOptions(suffix, retained)
+	topic := baseTopic + "/" + suffix
+	p.topics = append(p.topics, topic)
+	p.tokens = append(p.tokens, p.c.client.Publish(topic, qos, retained, payload))
+}
+
+// wait waits until all messages were delivered or PublishTimeout passed. Messages that
+// failed are reported through a PublishError.
+func (p *publisher) wait() error {
+	timeout := p.c.config.PublishTimeout
+	if timeout == 0 {
+		timeout = defaultPublishTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	errs := []error{}
+	for i, token := range p.tokens {
+		if !completed(token, time.Until(deadline)) {
+			errs = append(errs, fmt.Errorf("%s: timeout", p.topics[i]))
+		} else if token.Error() != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.topics[i], token.Error()))
+		}
+	}
+	if len(errs) > 0 {
+		metrics.MQTTPublishFailures.Inc()
+		return &PublishError{Errors: errs}
+	}
+	return nil
+}
+
+// completed waits up to timeout for the token. Tokens that already completed are
+// reported as such even if the timeout passed.
+func completed(token mqtt.Token, timeout time.Duration) bool {
+	select {
+	case <-token.Done():
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+	return token.WaitTimeout(timeout)
+}
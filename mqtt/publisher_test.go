@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeToken completes immediately with err, or never if pending is set. Like paho's
+// tokens, WaitTimeout may report a timeout for a completed token if the timeout already passed.
+type fakeToken struct {
+	err     error
+	pending bool
+}
+
+func (t *fakeToken) Wait() bool {
+	return !t.pending
+}
+
+func (t *fakeToken) WaitTimeout(timeout time.Duration) bool {
+	if t.pending {
+		time.Sleep(timeout)
+	}
+	return !t.pending && timeout > 0
+}
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	if !t.pending {
+		close(done)
+	}
+	return done
+}
+
+func (t *fakeToken) Error() error {
+	return t.err
+}
+
+func TestTopicOptions(t *testing.T) {
+	qos := byte(1)
+	retain := false
+	c := MQTTClient{config: &MQTTConfig{
+		QoS: 2,
+		Topics: map[string]TopicConfig{
+			"chunks":        {QoS: &qos},
+			"accent/chunks": {Retain: &retain},
+		},
+	}}
+
+	tests := []struct {
+		suffix   string
+		qos      byte
+		retained bool
+	}{
+		{"data", 2, true},
+		{"chunks/3", 1, true},
+		{"accent/chunks/12", 2, false},
+		{"accent/data", 2, true},
+	}
+	for _, test := range tests {
+		qos, retained := c.topicOptions(test.suffix, true)
+		if qos != test.qos || retained != test.retained {
+			t.Errorf("%s: got QoS %d and retain %t", test.suffix, qos, retained)
+		}
+	}
+
+	if validateQoS(&MQTTConfig{QoS: 3}) == nil {
+		t.Error("A QoS of 3 should be rejected")
+	}
+}
+
+func TestWait(t *testing.T) {
+	p := publisher{
+		c:      &MQTTClient{config: &MQTTConfig{PublishTimeout: 10 * time.Millisecond}},
+		topics: []string{"a/data", "a/format", "a/chunks/0"},
+		tokens: []mqtt.Token{&fakeToken{}, &fakeToken{err: errors.New("connection lost")}, &fakeToken{pending: true}},
+	}
+
+	err := p.wait()
+	var publishError *PublishError
+	if !errors.As(err, &publishError) || len(publishError.Errors) != 2 {
+		t.Fatalf("Expected two errors, got %v", err)
+	}
+	if err.Error() != "could not publish 2 messages, first error: a/format: connection lost" {
+		t.Errorf("Unexpected error message: %s", err)
+	}
+
+	p.tokens = p.tokens[:1]
+	if err := p.wait(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	// Completed tokens aren't reported as timeouts after the deadline passed
+	p.c.config.PublishTimeout = -time.Second
+	if err := p.wait(); err != nil {
+		t.Errorf("Expected no error after the deadline, got %v", err)
+	}
+}
@@ -2,8 +2,10 @@ package owm_handler
 
 import (
 	"errors"
+	"time"
 
 	owm "github.com/dschanoeh/go-owm"
+	"github.com/dschanoeh/what-to-wear/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -20,16 +22,22 @@ type WeatherReport struct {
 	FontAwesomeIcon string
 }
 
-func GetData(config OpenWeatherMapConfig) (*owm.WeatherData, *WeatherReport, error) {
-	weather, err := owm.GetWeather(config.Latitude, config.Longitude, config.APIKey)
+// GetData fetches the weather for the given coordinates
+func GetData(config OpenWeatherMapConfig, latitude float64, longitude float64) (*owm.WeatherData, *WeatherReport, error) {
+	start := time.Now()
+	weather, err := owm.GetWeather(latitude, longitude, config.APIKey)
+	metrics.ProviderFetchDuration.Observe(time.Since(start).Seconds())
 
 	if err != nil {
+		metrics.ProviderFetchErrors.Inc()
 		return nil, nil, err
 	}
 
 	if len(weather.Current.Weather) < 1 {
+		metrics.ProviderFetchErrors.Inc()
 		return nil, nil, errors.New("No current weather received")
 	}
+	metrics.SetDataTime(time.Now())
 	currentWeather := weather.Current.Weather[0]
 
 	report := WeatherReport{}
@@ -0,0 +1,134 @@
+package runner
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Policy determines what happens when a run is requested while another one is in progress
+type Policy int
+
+const (
+	// Join waits for the run in progress and shares its result
+	Join Policy = iota
+	// Skip doesn't start a run and returns immediately
+	Skip
+	// Queue waits for the run in progress and starts a new one afterwards
+	Queue
+)
+
+// ParsePolicy converts a configuration value to a Policy. An empty string results in Skip.
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "", "skip":
+		return Skip, nil
+	case "queue":
+		return Queue, nil
+	case "join":
+		return Join, nil
+	}
+	return Skip, fmt.Errorf("unknown overlap policy %s", s)
+}
+
+// Result describes the outcome of a run
+type Result struct {
+	ID       uint64    `json:"id"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Success  bool      `json:"success"`
+	Errors   []string  `json:"errors,omitempty"`
+	// Coalesced is true if the caller joined a run that was already in progress
+	Coalesced bool `json:"coalesced"`
+	// Skipped is true if no run was performed because another one was in progress
+	Skipped bool `json:"skipped"`
+}
+
+// Job is the function executed by a run. It receives a logger tagged with the
+// run ID and returns the errors that occurred.
+type Job func(logger *log.Entry) []error
+
+type pendingRun struct {
+	id     uint64
+	name   string
+	done   chan struct{}
+	result Result
+}
+
+// Coordinator makes sure only one job is running at a time.
+type Coordinator struct {
+	mutex   sync.Mutex
+	lastID  uint64
+	current *pendingRun
+}
+
+func New() *Coordinator {
+	return &Coordinator{}
+}
+
+// Run executes the job and returns its result. If a run is already in progress,
+// policy determines whether this call joins it, is skipped, or waits to start
+// a new run. Only runs of the same name can be joined, otherwise Join behaves like Queue.
+func (c *Coordinator) Run(name string, policy Policy, job Job) Result {
+	for {
+		c.mutex.Lock()
+		if c.current == nil {
+			break
+		}
+		p := c.current
+		c.mutex.Unlock()
+
+		switch {
+		case policy == Skip:
+			return Result{Skipped: true}
+		case policy == Join && p.name == name:
+			<-p.done
+			result := p.result
+			result.Coalesced = true
+			return result
+		default:
+			log.WithField("run", p.id).Infof("Run in progress, %s is waiting for it to finish", name)
+			<-p.done
+		}
+	}
+
+	c.lastID++
+	p := &pendingRun{id: c.lastID, name: name, done: make(chan struct{})}
+	c.current = p
+	c.mutex.Unlock()
+
+	c.execute(p, job)
+	return p.result
+}
+
+// execute runs the job and records its result. A job that panics is recorded as a
+// failed run, so it doesn't block the coordinator.
+func (c *Coordinator) execute(p *pendingRun, job Job) {
+	logger := log.WithField("run", p.id)
+	logger.Infof("Starting %s", p.name)
+	p.result.ID = p.id
+	p.result.Started = time.Now()
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("%s panicked: %v", p.name, r)
+			p.result.Errors = append(p.result.Errors, fmt.Sprintf("panic: %v", r))
+			p.result.Success = false
+		}
+		p.result.Finished = time.Now()
+		logger.Infof("Finished %s after %s with %d errors", p.name, p.result.Finished.Sub(p.result.Started), len(p.result.Errors))
+
+		c.mutex.Lock()
+		c.current = nil
+		c.mutex.Unlock()
+		close(p.done)
+	}()
+
+	errs := job(logger)
+	p.result.Success = len(errs) == 0
+	for _, err := range errs {
+		p.result.Errors = append(p.result.Errors, err.Error())
+	}
+}
@@ -0,0 +1,157 @@
+package runner
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// startBlockedRun starts a run that doesn't finish before release is closed
+func startBlockedRun(c *Coordinator, job Job, results chan<- Result) {
+	go func() {
+		results <- c.Run("test", Join, job)
+	}()
+	// Give the run time to start
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestRunsAreCoalesced(t *testing.T) {
+	var runs int32
+	release := make(chan struct{})
+	c := New()
+	job := func(logger *log.Entry) []error {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return []error{errors.New("failed")}
+	}
+
+	var wg sync.WaitGroup
+	results := make([]Result, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.Run("test", Join, job)
+		}(i)
+	}
+	// Give all callers time to join the first run
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if atomic.LoadInt32(&runs) != 1 {
+		t.Error("Expected one run, got ", runs)
+	}
+	coalesced := 0
+	for _, r := range results {
+		if r.Success || len(r.Errors) != 1 || r.ID != 1 {
+			t.Error("Unexpected result: ", r)
+		}
+		if r.Coalesced {
+			coalesced++
+		}
+	}
+	if coalesced != len(results)-1 {
+		t.Error("Expected all but one result to be coalesced, got ", coalesced)
+	}
+
+	// Once finished, a new run is started
+	r := c.Run("test", Join, job)
+	if r.Coalesced || r.ID != 2 || atomic.LoadInt32(&runs) != 2 {
+		t.Error("Expected a new run")
+	}
+}
+
+func TestSkip(t *testing.T) {
+	release := make(chan struct{})
+	c := New()
+	job := func(logger *log.Entry) []error {
+		<-release
+		return nil
+	}
+
+	results := make(chan Result, 1)
+	startBlockedRun(c, job, results)
+	r := c.Run("test", Skip, job)
+	if !r.Skipped {
+		t.Error("Expected the run to be skipped")
+	}
+	close(release)
+	if r := <-results; !r.Success || r.Skipped {
+		t.Error("Unexpected result of the first run: ", r)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	release := make(chan struct{})
+	var active, maxActive int32
+	c := New()
+	job := func(logger *log.Entry) []error {
+		n := atomic.AddInt32(&active, 1)
+		if n > atomic.LoadInt32(&maxActive) {
+			atomic.StoreInt32(&maxActive, n)
+		}
+		<-release
+		atomic.AddInt32(&active, -1)
+		return nil
+	}
+
+	results := make(chan Result, 1)
+	startBlockedRun(c, job, results)
+	queued := make(chan Result, 1)
+	go func() {
+		queued <- c.Run("test", Queue, job)
+	}()
+	// Joining a run of a different job has to wait as well
+	joined := make(chan Result, 1)
+	go func() {
+		joined <- c.Run("other", Join, job)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	first := <-results
+	second := <-queued
+	third := <-joined
+	if second.Coalesced || second.Skipped || second.ID <= first.ID {
+		t.Error("Expected a separate run after the first one, got ", second)
+	}
+	if third.Coalesced || third.Skipped || third.ID <= first.ID || third.ID == second.ID {
+		t.Error("Expected a separate run for a different job, got ", third)
+	}
+	if atomic.LoadInt32(&maxActive) != 1 {
+		t.Error("Runs overlapped")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for s, expected := range map[string]Policy{"": Skip, "skip": Skip, "queue": Queue, "join": Join} {
+		p, err := ParsePolicy(s)
+		if err != nil || p != expected {
+			t.Errorf("Unexpected policy for %s: %v", s, p)
+		}
+	}
+	if _, err := ParsePolicy("parallel"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestPanickingJob(t *testing.T) {
+	c := New()
+	r := c.Run("test", Skip, func(logger *log.Entry) []error {
+		panic("boom")
+	})
+	if r.Success || len(r.Errors) != 1 || r.Errors[0] != "panic: boom" {
+		t.Error("Expected the panic to be recorded as an error, got ", r)
+	}
+
+	// The coordinator must not stay blocked by the panicked run
+	r = c.Run("test", Skip, func(logger *log.Entry) []error { return nil })
+	if r.Skipped || !r.Success {
+		t.Error("Expected a new run after the panic, got ", r)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Credentials that grant access to a scope. A scope without any credentials is open to everyone.
+type Credentials struct {
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Tokens   []string `yaml:"tokens"`
+}
+
+type AuthConfig struct {
+	// Admin credentials grant access to all endpoints
+	Admin Credentials `yaml:"admin"`
+	// Device credentials grant access to the read-only display endpoints
+	Device Credentials `yaml:"device"`
+}
+
+type scope int
+
+const (
+	scopePublic scope = iota
+	scopeDisplay
+	scopeAdmin
+)
+
+func (c Credentials) enabled() bool {
+	return c.Username != "" || len(c.Tokens) > 0
+}
+
+func secureCompare(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// matches checks basic auth credentials as well as bearer tokens passed in the
+// Authorization header or the 'token' query parameter.
+func (c Credentials) matches(r *http.Request) bool {
+	if username, password, ok := r.BasicAuth(); ok && c.Username != "" {
+		return secureCompare(username, c.Username) && secureCompare(password, c.Password)
+	}
+
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if token == "" {
+		return false
+	}
+	for _, t := range c.Tokens {
+		if secureCompare(token, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeFor returns the scope an endpoint belongs to. Static files are public so
+// rendering the display doesn't require credentials for every asset.
+func scopeFor(path string) scope {
+	switch path {
+	case "/healthz", "/readyz":
+		return scopePublic
+	case "/devices", "/status", "/metrics", "/api/v1/refresh":
+		return scopeAdmin
+	case "/", "/eInkImage", "/eInkAccentImage", "/eInkRegions":
+		return scopeDisplay
+	}
+	if _, ok := imageFormats[path]; ok {
+		return scopeDisplay
+	}
+	return scopePublic
+}
+
+// authorized checks if a request may access an endpoint of the given scope.
+// Admin credentials are valid for the display scope as well.
+func (server *Server) authorized(r *http.Request, s scope) bool {
+	admin := server.config.Auth.Admin
+	device := server.config.Auth.Device
+
+	switch s {
+	case scopeAdmin:
+		return !admin.enabled() || admin.matches(r)
+	case scopeDisplay:
+		return !device.enabled() || device.matches(r) || (admin.enabled() && admin.matches(r))
+	default:
+		return true
+	}
+}
+
+func (server *Server) unauthorized(w http.ResponseWriter) {
+	if server.config.Auth.Admin.Username != "" || server.config.Auth.Device.Username != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="what-to-wear"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="what-to-wear"`)
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorization(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Auth = AuthConfig{
+		Admin:  Credentials{Username: "admin", Password: "secret", Tokens: []string{"admin-token"}},
+		Device: Credentials{Tokens: []string{"device-token"}},
+	}
+
+	anonymous := httptest.NewRequest("GET", "/", nil)
+	device := httptest.NewRequest("GET", "/", nil)
+	device.Header.Set("Authorization", "Bearer device-token")
+	deviceQuery := httptest.NewRequest("GET", "/?token=device-token", nil)
+	admin := httptest.NewRequest("GET", "/", nil)
+	admin.SetBasicAuth("admin", "secret")
+	adminToken := httptest.NewRequest("GET", "/", nil)
+	adminToken.Header.Set("Authorization", "Bearer admin-token")
+	wrongPassword := httptest.NewRequest("GET", "/", nil)
+	wrongPassword.SetBasicAuth("admin", "wrong")
+
+	cases := []struct {
+		name     string
+		request  *http.Request
+		expected [3]bool // public, display, admin
+	}{
+		{"anonymous", anonymous, [3]bool{true, false, false}},
+		{"device", device, [3]bool{true, true, false}},
+		{"device query", deviceQuery, [3]bool{true, true, false}},
+		{"admin", admin, [3]bool{true, true, true}},
+		{"admin token", adminToken, [3]bool{true, true, true}},
+		{"wrong password", wrongPassword, [3]bool{true, false, false}},
+	}
+
+	for _, c := range cases {
+		for i, sc := range []scope{scopePublic, scopeDisplay, scopeAdmin} {
+			if s.authorized(c.request, sc) != c.expected[i] {
+				t.Errorf("%s: expected %v for scope %d", c.name, c.expected[i], sc)
+			}
+		}
+	}
+}
+
+func TestUnauthorizedResponse(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Auth = AuthConfig{Admin: Credentials{Username: "admin", Password: "secret"}}
+
+	rec := httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/status", nil))
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("Expected 401 with challenge, got ", rec.Code)
+	}
+
+	// Without device credentials, display endpoints stay open
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/eInkImage", nil))
+	if rec.Code == http.StatusUnauthorized {
+		t.Error("Display endpoint should be open without device credentials")
+	}
+}
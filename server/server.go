@@ -1,14 +1,62 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"html/template"
+	"image"
+	"image/png"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/dschanoeh/what-to-wear/compression"
+	"github.com/dschanoeh/what-to-wear/devices"
+	"github.com/dschanoeh/what-to-wear/imaging"
+	"github.com/dschanoeh/what-to-wear/metrics"
+	"github.com/dschanoeh/what-to-wear/runner"
+	"github.com/dschanoeh/what-to-wear/status"
 	log "github.com/sirupsen/logrus"
 )
 
+// StaticDir contains the files served next to the pages, e.g. style sheets and fonts
+const StaticDir = "static"
+
+var errUnknownVariant = errors.New("unknown variant")
+
 type ServerConfig struct {
 	Listen string `yaml:"listen"`
+	// StaleAfter is the maximum age of the weather data before /readyz fails. 0 disables the check.
+	StaleAfter time.Duration `yaml:"stale_after"`
+	Auth       AuthConfig    `yaml:"auth"`
+	TLSCert    string        `yaml:"tls_cert"`
+	TLSKey     string        `yaml:"tls_key"`
+	// RedirectListen is an optional plain HTTP listener that redirects to HTTPS
+	RedirectListen string `yaml:"redirect_listen"`
+}
+
+type BuildInfo struct {
+	Version string
+	Commit  string
+	Date    string
+	BuiltBy string
+}
+
+// Status describes the state of the application for the status and readiness endpoints
+type Status struct {
+	Subsystems    []status.Subsystem
+	MQTTConnected bool
+	NextRun       time.Time
+	DataTime      time.Time
+	Build         BuildInfo
 }
 
 type Content struct {
@@ -21,52 +69,421 @@ type Content struct {
 	FontAwesomeIcon string
 }
 
+// Hash returns a hash of the content that ignores the creation time, so it only
+// changes if something visible on the display (besides the timestamp) changes.
+func (c Content) Hash() string {
+	c.CreationTime = ""
+	data, err := json.Marshal(c)
+	if err != nil {
+		// Content only consists of strings, this can't happen
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type imageFormat struct {
+	name        string
+	contentType string
+	encode      func(io.Writer, *image.Gray) error
+	// encodeColor is used for images of color pixel formats if set
+	encodeColor func(io.Writer, image.Image) error
+}
+
+var imageFormats = map[string]imageFormat{
+	"/image.png": {name: "png", contentType: "image/png", encode: imaging.EncodePNG, encodeColor: png.Encode},
+	"/image.bmp": {name: "bmp", contentType: "image/bmp", encode: imaging.EncodeBMP},
+	"/image.pbm": {name: "pbm", contentType: "image/x-portable-bitmap", encode: imaging.EncodePBM},
+}
+
+// Image is the display data of a variant
+type Image struct {
+	// Data is the packed display buffer. For tri-color displays, it contains the black plane.
+	Data []byte
+	// Accent is the packed accent plane of tri-color displays and nil otherwise
+	Accent []byte
+	// Gray is the image Data was generated from
+	Gray *image.Gray
+	// Format describes how Data is packed
+	Format imaging.Format
+	// Color is the image Data was generated from for color pixel formats
+	Color image.Image
+	// Version identifies the image so device fetches can be tracked
+	Version string
+	// Refresh describes the regions that changed since the previous image. It is nil
+	// if partial refresh is disabled.
+	Refresh *imaging.Refresh
+}
+
+type imageData struct {
+	*Image
+	etag         string
+	lastModified time.Time
+}
+
 type Server struct {
 	config            ServerConfig
-	currentContent    *Content
+	registry          *devices.Registry
+	statusSource      func() Status
+	refresh           func() runner.Result
+	mutex             sync.RWMutex
+	currentContent    map[string]*Content
+	currentImageData  map[string]*imageData
 	staticFileHandler http.Handler
-	currentImageData  []byte
+	metricsHandler    http.Handler
 	httpServer        *http.Server
+	redirectServer    *http.Server
+	certificates      *certificateStore
 }
 
-func New(c ServerConfig) *Server {
+// New creates a server. statusSource is called whenever the status of the
+// application is requested.
+func New(c ServerConfig, registry *devices.Registry, statusSource func() Status) *Server {
 	mux := http.NewServeMux()
 	s := Server{
 		config:            c,
-		staticFileHandler: http.FileServer(http.Dir("./static/")),
+		registry:          registry,
+		statusSource:      statusSource,
+		currentContent:    map[string]*Content{},
+		currentImageData:  map[string]*imageData{},
+		staticFileHandler: http.FileServer(http.Dir(StaticDir)),
+		metricsHandler:    metrics.Handler(),
 		httpServer:        &http.Server{Addr: c.Listen, Handler: mux},
 	}
 
 	mux.HandleFunc("/", s.genericHandler)
+
+	if c.TLSEnabled() {
+		s.certificates = &certificateStore{certFile: c.TLSCert, keyFile: c.TLSKey}
+		s.httpServer.TLSConfig = &tls.Config{GetCertificate: s.certificates.getCertificate}
+		if c.RedirectListen != "" {
+			s.redirectServer = &http.Server{Addr: c.RedirectListen, Handler: http.HandlerFunc(s.redirectHandler)}
+		}
+	}
 	return &s
 }
 
+// variantForRequest picks the variant to serve. Devices identify themselves through the
+// 'device' or 'client_id' query parameters, the renderer uses the 'variant' parameter.
+func (server *Server) variantForRequest(r *http.Request) (*devices.Variant, *devices.Device, error) {
+	query := r.URL.Query()
+	if id := query.Get("variant"); id != "" {
+		v := server.registry.Variant(id)
+		if v == nil {
+			return nil, nil, errUnknownVariant
+		}
+		return v, nil, nil
+	}
+
+	d, err := server.registry.Identify(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d != nil {
+		return d.Variant, d, nil
+	}
+	return server.registry.Variant(devices.DefaultVariantID), nil, nil
+}
+
 func (server *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFiles("templates/index.gohtml")
+	variant, _, err := server.variantForRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	server.mutex.RLock()
+	content := server.currentContent[variant.ID]
+	server.mutex.RUnlock()
+	err = RenderPage(w, variant.Layout, content)
+	if err != nil {
+		log.Warn("Error when rendering template: ", err)
+		return
+	}
+}
+
+// RenderPage executes a layout template from the templates folder with the given content.
+// Assets referenced by the page are located in StaticDir.
+func RenderPage(w io.Writer, layout string, content *Content) error {
+	t, err := template.ParseFiles("templates/" + layout)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, content)
+}
+
+func (server *Server) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := template.ParseFiles("templates/devices.gohtml")
 	if err != nil {
 		log.Warn("Error when parsing template: ", err)
 		return
 	}
-	err = t.Execute(w, server.currentContent)
+	err = t.Execute(w, server.registry.Status())
 	if err != nil {
 		log.Warn("Error when executing template: ", err)
 		return
 	}
 }
 
-func (server *Server) UpdateImage(data []byte) {
-	server.currentImageData = data
+// OnRefresh sets the function that is called when a refresh is requested through the API
+func (server *Server) OnRefresh(refresh func() runner.Result) {
+	server.refresh = refresh
+}
+
+// refreshHandler triggers an update and responds with its outcome once it is done
+func (server *Server) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if server.refresh == nil {
+		http.Error(w, "refresh not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	result := server.refresh()
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Success {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Warn("Error when encoding refresh result: ", err)
+	}
 }
 
-func (server *Server) imageHandler(w http.ResponseWriter, r *http.Request) {
-	if server.currentImageData != nil && len(server.currentImageData) > 0 {
-		w.Write(server.currentImageData)
+func (server *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := template.ParseFiles("templates/status.gohtml")
+	if err != nil {
+		log.Warn("Error when parsing template: ", err)
+		return
+	}
+	err = t.Execute(w, server.statusSource())
+	if err != nil {
+		log.Warn("Error when executing template: ", err)
+		return
 	}
 }
 
+func (server *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyHandler fails if no weather data was received yet or if it is older than StaleAfter
+func (server *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	s := server.statusSource()
+	if s.DataTime.IsZero() {
+		http.Error(w, "no data available yet", http.StatusServiceUnavailable)
+		return
+	}
+	if server.config.StaleAfter > 0 && time.Since(s.DataTime) > server.config.StaleAfter {
+		http.Error(w, "data is stale, last update at "+s.DataTime.Format(time.RFC3339), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// UpdateImage sets the image data served for a variant.
+func (server *Server) UpdateImage(variantID string, img *Image) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	hash := sha256.New()
+	hash.Write(img.Data)
+	hash.Write(img.Accent)
+	sum := hash.Sum(nil)
+	image := imageData{
+		Image:        img,
+		etag:         `"` + hex.EncodeToString(sum[:16]) + `"`,
+		lastModified: time.Now(),
+	}
+	// Keep the modification time if the image didn't change so If-Modified-Since keeps working
+	if previous, ok := server.currentImageData[variantID]; ok && previous.etag == image.etag {
+		image.lastModified = previous.lastModified
+	}
+	server.currentImageData[variantID] = &image
+}
+
+func (server *Server) currentImage(r *http.Request) (*imageData, *devices.Device, error) {
+	variant, device, err := server.variantForRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	server.mutex.RLock()
+	image := server.currentImageData[variant.ID]
+	server.mutex.RUnlock()
+	return image, device, nil
+}
+
+// derivedETag returns a distinct ETag for another representation of the same image
+func derivedETag(etag string, suffix string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + suffix + `"`
+}
+
+// acceptedCompression returns the first compression listed in the Accept-Encoding
+// header of the request that is supported, or compression.None
+func acceptedCompression(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if !compression.Compressed(name) || compression.Validate(name) != nil {
+			continue
+		}
+		accepted := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		if accepted {
+			return name
+		}
+	}
+	return compression.None
+}
+
+// imageHandler serves the packed display buffer, or its accent plane if accent is set
+func (server *Server) imageHandler(w http.ResponseWriter, r *http.Request, accent bool) {
+	image, device, err := server.currentImage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if image == nil || len(image.Data) == 0 {
+		http.Error(w, "no image available yet", http.StatusServiceUnavailable)
+		return
+	}
+	data, etag := image.Data, image.etag
+	if accent {
+		if image.Accent == nil {
+			http.Error(w, "the palette has no accent color", http.StatusNotFound)
+			return
+		}
+		data, etag = image.Accent, derivedETag(image.etag, "accent")
+	}
+	w.Header().Set("Vary", "Accept-Encoding")
+	if encoding := acceptedCompression(r); encoding != compression.None {
+		data, err = compression.Encode(encoding, data)
+		if err != nil {
+			log.Warn("Error when compressing image: ", err)
+			http.Error(w, "could not compress image", http.StatusInternalServerError)
+			return
+		}
+		etag = derivedETag(etag, encoding)
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if !accent && image.Format.PixelFormat != "" {
+		w.Header().Set("X-Pixel-Format", image.Format.PixelFormat)
+		w.Header().Set("X-Bits-Per-Pixel", strconv.Itoa(image.Format.BitsPerPixel))
+		w.Header().Set("X-Image-Width", strconv.Itoa(image.Format.Width))
+		w.Header().Set("X-Image-Height", strconv.Itoa(image.Format.Height))
+		w.Header().Set("X-Image-Stride", strconv.Itoa(image.Format.Stride))
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	// ServeContent takes care of Content-Length, If-None-Match, and If-Modified-Since
+	http.ServeContent(w, r, "", image.lastModified, bytes.NewReader(data))
+	if device != nil {
+		server.registry.RecordFetch(device, image.Version)
+	}
+}
+
+// regionsHandler serves the regions that changed since the previous image as JSON
+func (server *Server) regionsHandler(w http.ResponseWriter, r *http.Request) {
+	image, device, err := server.currentImage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if image == nil || len(image.Data) == 0 {
+		http.Error(w, "no image available yet", http.StatusServiceUnavailable)
+		return
+	}
+	if image.Refresh == nil {
+		http.Error(w, "partial refresh is disabled", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(image.Refresh)
+	if err != nil {
+		log.Warn("Error when encoding regions: ", err)
+		http.Error(w, "could not encode regions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", derivedETag(image.etag, "regions"))
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", image.lastModified, bytes.NewReader(data))
+	if device != nil {
+		server.registry.RecordFetch(device, image.Version)
+	}
+}
+
+// encodedImageHandler serves the current image in a standard image format
+func (server *Server) encodedImageHandler(w http.ResponseWriter, r *http.Request, format imageFormat) {
+	image, _, err := server.currentImage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if image == nil || image.Gray == nil {
+		http.Error(w, "no image available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	var buf bytes.Buffer
+	if image.Color != nil && format.encodeColor != nil {
+		err = format.encodeColor(&buf, image.Color)
+	} else {
+		err = format.encode(&buf, image.Gray)
+	}
+	if err != nil {
+		log.Warn("Error when encoding image: ", err)
+		http.Error(w, "could not encode image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("ETag", derivedETag(image.etag, format.name))
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", image.lastModified, bytes.NewReader(buf.Bytes()))
+}
+
 func (server *Server) genericHandler(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r, scopeFor(r.URL.Path)) {
+		server.unauthorized(w)
+		return
+	}
+
 	if r.URL.Path == "/eInkImage" {
-		server.imageHandler(w, r)
+		server.imageHandler(w, r, false)
+	} else if r.URL.Path == "/eInkAccentImage" {
+		server.imageHandler(w, r, true)
+	} else if r.URL.Path == "/eInkRegions" {
+		server.regionsHandler(w, r)
+	} else if format, ok := imageFormats[r.URL.Path]; ok {
+		server.encodedImageHandler(w, r, format)
+	} else if r.URL.Path == "/healthz" {
+		server.healthHandler(w, r)
+	} else if r.URL.Path == "/readyz" {
+		server.readyHandler(w, r)
+	} else if r.URL.Path == "/api/v1/refresh" {
+		server.refreshHandler(w, r)
+	} else if r.URL.Path == "/metrics" {
+		server.metricsHandler.ServeHTTP(w, r)
+	} else if r.URL.Path == "/status" {
+		server.statusHandler(w, r)
+	} else if r.URL.Path == "/devices" {
+		server.devicesHandler(w, r)
 	} else if r.URL.Path == "/" {
 		server.indexHandler(w, r)
 	} else {
@@ -74,18 +491,48 @@ func (server *Server) genericHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (server *Server) UpdateData(data *Content) {
-	server.currentContent = data
+// UpdateData sets the content that is displayed for a variant.
+func (server *Server) UpdateData(variantID string, data *Content) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.currentContent[variantID] = data
 }
 
-func (server *Server) Serve() {
-	log.Infof("Listening at %s ...", server.config.Listen)
-	err := server.httpServer.ListenAndServe()
-	if err != nil {
-		log.Error(err)
+// Serve blocks until the server fails or is shut down. After Shutdown, nil is returned.
+func (server *Server) Serve() error {
+	var err error
+	if server.certificates == nil {
+		log.Infof("Listening at %s ...", server.config.Listen)
+		err = server.httpServer.ListenAndServe()
+	} else {
+		err = server.certificates.load()
+		if err != nil {
+			return err
+		}
+		if server.redirectServer != nil {
+			go func() {
+				log.Infof("Redirecting HTTP requests at %s ...", server.config.RedirectListen)
+				err := server.redirectServer.ListenAndServe()
+				if err != nil && err != http.ErrServerClosed {
+					log.Error(err)
+				}
+			}()
+		}
+		log.Infof("Listening with TLS at %s ...", server.config.Listen)
+		// The certificate is provided through the TLS config
+		err = server.httpServer.ListenAndServeTLS("", "")
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
 	}
+	return err
 }
 
-func (server *Server) Close() error {
-	return server.httpServer.Close()
+// Shutdown stops accepting connections and waits for in-flight requests until ctx expires
+func (server *Server) Shutdown(ctx context.Context) error {
+	if server.redirectServer != nil {
+		server.redirectServer.Shutdown(ctx)
+	}
+	return server.httpServer.Shutdown(ctx)
 }
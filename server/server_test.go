@@ -0,0 +1,264 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dschanoeh/what-to-wear/devices"
+	"github.com/dschanoeh/what-to-wear/imaging"
+	"github.com/dschanoeh/what-to-wear/runner"
+)
+
+var testStatus Status
+
+func newTestServer(t *testing.T) *Server {
+	registry, err := devices.New(nil, devices.Location{}, "what-to-wear")
+	if err != nil {
+		t.Fatal("Could not create registry: ", err)
+	}
+	return New(ServerConfig{StaleAfter: time.Hour}, registry, func() Status {
+		return testStatus
+	})
+}
+
+func TestImageConditionalRequests(t *testing.T) {
+	s := newTestServer(t)
+	s.UpdateImage(devices.DefaultVariantID, &Image{Data: []byte{0x00, 0xff, 0x0f}, Version: "1"})
+
+	rec := httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/eInkImage", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatal("Unexpected status: ", rec.Code)
+	}
+	if rec.Header().Get("Content-Length") != "3" {
+		t.Error("Unexpected Content-Length: ", rec.Header().Get("Content-Length"))
+	}
+	if rec.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Error("Unexpected Content-Type: ", rec.Header().Get("Content-Type"))
+	}
+	etag := rec.Header().Get("ETag")
+	lastModified := rec.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatal("Missing caching headers")
+	}
+
+	req := httptest.NewRequest("GET", "/eInkImage", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Error("Expected 304 for matching ETag, got ", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/eInkImage", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Error("Expected 304 for If-Modified-Since, got ", rec.Code)
+	}
+
+	// An identical image must keep the validators
+	s.UpdateImage(devices.DefaultVariantID, &Image{Data: []byte{0x00, 0xff, 0x0f}, Version: "2"})
+	req = httptest.NewRequest("GET", "/eInkImage", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Error("Expected 304 for unchanged image, got ", rec.Code)
+	}
+
+	s.UpdateImage(devices.DefaultVariantID, &Image{Data: []byte{0xff, 0xff, 0x0f}, Version: "3"})
+	req = httptest.NewRequest("GET", "/eInkImage", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Error("Expected 200 for changed image, got ", rec.Code)
+	}
+}
+
+func TestAccentImage(t *testing.T) {
+	s := newTestServer(t)
+	s.UpdateImage(devices.DefaultVariantID, &Image{Data: []byte{0x00, 0xff}, Version: "1"})
+
+	rec := httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/eInkAccentImage", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 without accent plane, got ", rec.Code)
+	}
+
+	s.UpdateImage(devices.DefaultVariantID, &Image{Data: []byte{0x00, 0xff}, Accent: []byte{0xf0, 0xff}, Version: "2"})
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/eInkAccentImage", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatal("Unexpected status: ", rec.Code)
+	}
+	if rec.Body.String() != "\xf0\xff" {
+		t.Errorf("Unexpected body %x", rec.Body.Bytes())
+	}
+	accentETag := rec.Header().Get("ETag")
+
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/eInkImage", nil))
+	if rec.Body.String() != "\x00\xff" {
+		t.Errorf("Unexpected body %x", rec.Body.Bytes())
+	}
+	if rec.Header().Get("ETag") == accentETag {
+		t.Error("The planes must have different ETags")
+	}
+}
+
+func TestImageFormatHeaders(t *testing.T) {
+	s := newTestServer(t)
+	format := imaging.Format{PixelFormat: "2bpp", BitsPerPixel: 2, Width: 8, Height: 1, Stride: 2}
+	s.UpdateImage(devices.DefaultVariantID, &Image{Data: []byte{0x1b, 0x32}, Format: format, Version: "1"})
+
+	rec := httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/eInkImage", nil))
+	if rec.Header().Get("X-Pixel-Format") != "2bpp" || rec.Header().Get("X-Bits-Per-Pixel") != "2" {
+		t.Error("Unexpected format headers: ", rec.Header())
+	}
+	if rec.Header().Get("X-Image-Width") != "8" || rec.Header().Get("X-Image-Height") != "1" || rec.Header().Get("X-Image-Stride") != "2" {
+		t.Error("Unexpected size headers: ", rec.Header())
+	}
+}
+
+func TestImageUnknownDevice(t *testing.T) {
+	s := newTestServer(t)
+	rec := httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/eInkImage?device=garage", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 for unknown device, got ", rec.Code)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	s := newTestServer(t)
+
+	testStatus = Status{}
+	rec := httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Error("Expected 503 without data, got ", rec.Code)
+	}
+
+	testStatus = Status{DataTime: time.Now().Add(-2 * time.Hour)}
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Error("Expected 503 for stale data, got ", rec.Code)
+	}
+
+	testStatus = Status{DataTime: time.Now()}
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("Expected 200 for fresh data, got ", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("Expected 200 for liveness, got ", rec.Code)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/api/v1/refresh", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Error("Expected 405 for GET, got ", rec.Code)
+	}
+
+	s.OnRefresh(func() runner.Result {
+		return runner.Result{Success: false, Errors: []string{"provider failed"}}
+	})
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("POST", "/api/v1/refresh", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Error("Expected 500 for a failed refresh, got ", rec.Code)
+	}
+	var result runner.Result
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal("Could not decode result: ", err)
+	}
+	if len(result.Errors) != 1 || result.Errors[0] != "provider failed" {
+		t.Error("Unexpected result: ", result)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	a := Content{WeatherReport: "12°C - rain", Messages: []template.HTML{"Bring an umbrella"}, CreationTime: "Monday"}
+	b := a
+	b.CreationTime = "Tuesday"
+	if a.Hash() != b.Hash() {
+		t.Error("Content that only differs in creation time should have the same hash")
+	}
+	b.Messages = []template.HTML{"Bring two umbrellas"}
+	if a.Hash() == b.Hash() {
+		t.Error("Content with different messages should have different hashes")
+	}
+}
+
+func TestRegions(t *testing.T) {
+	s := newTestServer(t)
+	s.UpdateImage(devices.DefaultVariantID, &Image{Data: []byte{0x00}, Version: "1"})
+
+	rec := httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/eInkRegions", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without partial refresh, got %d", rec.Code)
+	}
+
+	refresh := &imaging.Refresh{
+		Regions:     []imaging.Region{{X: 8, Y: 3, Width: 8, Height: 1, Data: []byte{0x0f}}},
+		Version:     "2",
+		BaseVersion: "1",
+	}
+	s.UpdateImage(devices.DefaultVariantID, &Image{Data: []byte{0x0f}, Version: "2", Refresh: refresh})
+
+	rec = httptest.NewRecorder()
+	s.genericHandler(rec, httptest.NewRequest("GET", "/eInkRegions", nil))
+	expected := `{"full":false,"regions":[{"x":8,"y":3,"width":8,"height":1,"data":"Dw=="}],"version":"2","base_version":"1"}`
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := newTestServer(t)
+	s.UpdateImage(devices.DefaultVariantID, &Image{Data: []byte{0xff, 0xff, 0xff, 0x00}, Version: "1"})
+
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"", "", "\xff\xff\xff\x00"},
+		{"gzip, deflate", "", "\xff\xff\xff\x00"},
+		{"gzip, packbits", "packbits", "\xfe\xff\x00\x00"},
+		{"heatshrink;q=0, packbits;q=0.5", "packbits", "\xfe\xff\x00\x00"},
+		{"Heatshrink", "heatshrink", "\xff\x80\x06\x00"},
+	}
+	etags := map[string]bool{}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/eInkImage", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		rec := httptest.NewRecorder()
+		s.genericHandler(rec, req)
+		if rec.Header().Get("Content-Encoding") != test.encoding || rec.Body.String() != test.body {
+			t.Errorf("%s: unexpected encoding %s and body %x", test.acceptEncoding, rec.Header().Get("Content-Encoding"), rec.Body.Bytes())
+		}
+		etags[rec.Header().Get("ETag")] = true
+	}
+	if len(etags) != 3 {
+		t.Error("Every encoding needs its own ETag: ", etags)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certificateStore holds the current certificate so it can be replaced while serving
+type certificateStore struct {
+	mutex       sync.RWMutex
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+}
+
+func (s *certificateStore) load() error {
+	certificate, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.certificate = &certificate
+	return nil
+}
+
+func (s *certificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.certificate, nil
+}
+
+// TLSEnabled returns true if a certificate and key are configured
+func (c ServerConfig) TLSEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// ReloadCertificate reads the certificate and key files again. If loading fails,
+// the previous certificate stays in use.
+func (server *Server) ReloadCertificate() error {
+	if server.certificates == nil {
+		return nil
+	}
+	err := server.certificates.load()
+	if err != nil {
+		return err
+	}
+	log.Info("Reloaded TLS certificate")
+	return nil
+}
+
+// redirectHandler sends clients to the same URL on the HTTPS listener
+func (server *Server) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(server.config.Listen); err == nil && port != "443" && port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
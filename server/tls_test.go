@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "what-to-wear-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestCertificate(t, dir, "first")
+	store := certificateStore{certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	if err := store.load(); err != nil {
+		t.Fatal("Could not load certificate: ", err)
+	}
+	first, _ := store.getCertificate(nil)
+
+	writeTestCertificate(t, dir, "second")
+	if err := store.load(); err != nil {
+		t.Fatal("Could not reload certificate: ", err)
+	}
+	second, _ := store.getCertificate(nil)
+	if first == second {
+		t.Error("Certificate was not replaced")
+	}
+
+	// A broken certificate must not replace the working one
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("garbage"), 0600)
+	if err := store.load(); err == nil {
+		t.Error("Expected an error for an invalid certificate")
+	}
+	current, _ := store.getCertificate(nil)
+	if current != second {
+		t.Error("Certificate was replaced by an invalid one")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	s := newTestServer(t)
+
+	cases := map[string]string{
+		":7443": "https://example.com:7443/eInkImage?device=kitchen",
+		":443":  "https://example.com/eInkImage?device=kitchen",
+	}
+	for listen, expected := range cases {
+		s.config.Listen = listen
+		rec := httptest.NewRecorder()
+		s.redirectHandler(rec, httptest.NewRequest("GET", "http://example.com:7000/eInkImage?device=kitchen", nil))
+		if rec.Code != http.StatusMovedPermanently {
+			t.Error("Unexpected status: ", rec.Code)
+		}
+		if rec.Header().Get("Location") != expected {
+			t.Errorf("Redirected to %s instead of %s", rec.Header().Get("Location"), expected)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package status
+
+import (
+	"sync"
+	"time"
+)
+
+// Names of the subsystems whose state is tracked
+const (
+	Provider  = "provider"
+	Evaluator = "evaluator"
+	Imaging   = "imaging"
+	MQTT      = "mqtt"
+)
+
+type Subsystem struct {
+	Name          string
+	LastSuccess   time.Time
+	LastError     string
+	LastErrorTime time.Time
+}
+
+// Healthy returns false if the last operation of the subsystem failed
+func (s Subsystem) Healthy() bool {
+	return s.LastErrorTime.IsZero() || s.LastSuccess.After(s.LastErrorTime)
+}
+
+// Tracker records the outcome of the latest operations of each subsystem
+type Tracker struct {
+	mutex      sync.RWMutex
+	names      []string
+	subsystems map[string]*Subsystem
+}
+
+func NewTracker(names ...string) *Tracker {
+	t := Tracker{subsystems: map[string]*Subsystem{}}
+	for _, name := range names {
+		t.subsystem(name)
+	}
+	return &t
+}
+
+func (t *Tracker) subsystem(name string) *Subsystem {
+	s, ok := t.subsystems[name]
+	if !ok {
+		s = &Subsystem{Name: name}
+		t.subsystems[name] = s
+		t.names = append(t.names, name)
+	}
+	return s
+}
+
+// Report records a success if err is nil and a failure otherwise
+func (t *Tracker) Report(name string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	s := t.subsystem(name)
+	if err == nil {
+		s.LastSuccess = time.Now()
+	} else {
+		s.LastError = err.Error()
+		s.LastErrorTime = time.Now()
+	}
+}
+
+// Get returns a copy of the state of a subsystem
+func (t *Tracker) Get(name string) Subsystem {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if s, ok := t.subsystems[name]; ok {
+		return *s
+	}
+	return Subsystem{Name: name}
+}
+
+// Subsystems returns a copy of the state of all subsystems in the order they were added
+func (t *Tracker) Subsystems() []Subsystem {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	subsystems := make([]Subsystem, 0, len(t.names))
+	for _, name := range t.names {
+		subsystems = append(subsystems, *t.subsystems[name])
+	}
+	return subsystems
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"time"
+
+	owm "github.com/dschanoeh/go-owm"
+	"github.com/dschanoeh/what-to-wear/compression"
+	"github.com/dschanoeh/what-to-wear/devices"
+	"github.com/dschanoeh/what-to-wear/evaluator"
+	"github.com/dschanoeh/what-to-wear/imaging"
+	"github.com/dschanoeh/what-to-wear/metrics"
+	"github.com/dschanoeh/what-to-wear/owm_handler"
+	"github.com/dschanoeh/what-to-wear/runner"
+	"github.com/dschanoeh/what-to-wear/server"
+	"github.com/dschanoeh/what-to-wear/status"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the jobs run through the update coordinator
+const (
+	jobUpdate   = "update"
+	jobRefresh  = "refresh"
+	jobFetch    = "fetch"
+	jobEvaluate = "evaluate"
+)
+
+type weatherResult struct {
+	data   *owm.WeatherData
+	report *owm_handler.WeatherReport
+}
+
+// renderState remembers what was last rendered and published for a variant
+type renderState struct {
+	contentHash string
+	imageHash   string
+	// version of the last published image
+	version string
+}
+
+var (
+	// Latest weather data per location and the render state per variant.
+	// Both are only accessed from jobs, which never run concurrently.
+	weatherCache = map[devices.Location]*weatherResult{}
+	renderStates = map[string]*renderState{}
+)
+
+// cronJobWrappers converts the configured wrapper names to cron job wrappers
+func cronJobWrappers(names []string) ([]cron.JobWrapper, error) {
+	logger := cron.PrintfLogger(log.StandardLogger())
+	wrappers := []cron.JobWrapper{}
+	for _, name := range names {
+		switch name {
+		case "recover":
+			wrappers = append(wrappers, cron.Recover(logger))
+		case "skip_if_still_running":
+			wrappers = append(wrappers, cron.SkipIfStillRunning(logger))
+		case "delay_if_still_running":
+			wrappers = append(wrappers, cron.DelayIfStillRunning(logger))
+		default:
+			return nil, fmt.Errorf("unknown cron job wrapper %s", name)
+		}
+	}
+	return wrappers, nil
+}
+
+// scheduleJobs adds the configured schedules to the scheduler. cron_expression runs
+// complete updates, fetch_schedule and evaluate_schedule allow separating both steps.
+func scheduleJobs(scheduler *cron.Cron, config *Config) error {
+	schedules := []struct {
+		expression string
+		name       string
+		job        runner.Job
+	}{
+		{config.CronExpression, jobUpdate, updateData},
+		{config.FetchSchedule, jobFetch, fetchData},
+		{config.EvaluateSchedule, jobEvaluate, evaluateData},
+	}
+
+	scheduled := 0
+	for _, s := range schedules {
+		if s.expression == "" {
+			continue
+		}
+		name := s.name
+		job := s.job
+		_, err := scheduler.AddFunc(s.expression, func() { scheduledRun(name, job, "schedule") })
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		scheduled++
+	}
+
+	if scheduled == 0 {
+		return errors.New("neither cron_expression nor fetch_schedule or evaluate_schedule is set")
+	}
+	return nil
+}
+
+// scheduledRun runs a job according to the configured overlap policy
+func scheduledRun(name string, job runner.Job, trigger string) {
+	log.Infof("%s triggered by %s", name, trigger)
+	result := updateCoordinator.Run(name, scheduledRunPolicy, job)
+	if result.Skipped {
+		log.Warnf("Skipped %s triggered by %s because another job is still running", name, trigger)
+	}
+}
+
+// refresh triggers an immediate update. Concurrent requests are coalesced and
+// requests are rejected once shutdown began.
+func refresh(trigger string) runner.Result {
+	shuttingDownMutex.Lock()
+	if shuttingDown {
+		shuttingDownMutex.Unlock()
+		log.Warnf("Rejected refresh requested through %s during shutdown", trigger)
+		return runner.Result{Errors: []string{"shutting down"}}
+	}
+	runningUpdates.Add(1)
+	shuttingDownMutex.Unlock()
+	defer runningUpdates.Done()
+
+	log.Infof("Refresh requested through %s", trigger)
+	result := updateCoordinator.Run(jobRefresh, runner.Join, refreshData)
+	if result.Coalesced {
+		log.Info("Refresh joined an update that was already running")
+	}
+	return result
+}
+
+// updateData fetches new weather data and renders the variants whose content changed
+func updateData(logger *log.Entry) []error {
+	logger.Info("Updating data...")
+	errs := fetchWeather(logger)
+	return append(errs, evaluateVariants(logger, false)...)
+}
+
+// refreshData fetches new weather data and renders and publishes all variants
+// regardless of whether they changed
+func refreshData(logger *log.Entry) []error {
+	logger.Info("Refreshing data...")
+	errs := fetchWeather(logger)
+	return append(errs, evaluateVariants(logger, true)...)
+}
+
+// fetchData fetches new weather data and renders the variants whose content changed
+func fetchData(logger *log.Entry) []error {
+	errs := fetchWeather(logger)
+	return append(errs, evaluateVariants(logger, false)...)
+}
+
+// evaluateData re-evaluates the messages with the current weather data and renders
+// the variants whose content changed
+func evaluateData(logger *log.Entry) []error {
+	return evaluateVariants(logger, false)
+}
+
+// fetchWeather updates the weather data of all locations used by variants.
+// If fetching fails, the previous data of a location is kept.
+func fetchWeather(logger *log.Entry) []error {
+	logger.Info("Fetching weather data...")
+	errs := []error{}
+	fetched := map[devices.Location]bool{}
+	for _, v := range registry.Variants() {
+		if fetched[v.Location] {
+			continue
+		}
+		fetched[v.Location] = true
+
+		data, report, err := owm_handler.GetData(config.OpenWeatherMap, v.Location.Latitude, v.Location.Longitude)
+		statusTracker.Report(status.Provider, err)
+		if err != nil {
+			logger.Errorf("Didn't receive updated information for %s: %s", v.Location, err)
+			errs = append(errs, fmt.Errorf("%s: %w", v.Location, err))
+			continue
+		}
+		logger.Debugf("Evaluation data: %+v\n", data)
+		logger.Infof("Weather report: %+v\n", report)
+		weatherCache[v.Location] = &weatherResult{data: data, report: report}
+	}
+	return errs
+}
+
+// evaluateVariants evaluates the messages of all variants. Variants are rendered and
+// published if force is set or their content changed since they were last rendered.
+func evaluateVariants(logger *log.Entry, force bool) []error {
+	errs := []error{}
+	for _, v := range registry.Variants() {
+		for _, err := range evaluateVariant(logger.WithField("variant", v.ID), v, force) {
+			errs = append(errs, fmt.Errorf("%s: %w", v.ID, err))
+		}
+	}
+	return errs
+}
+
+func evaluateVariant(logger *log.Entry, v *devices.Variant, force bool) []error {
+	errs := []error{}
+	w, ok := weatherCache[v.Location]
+	if !ok {
+		logger.Error("No weather data available. Skipping update.")
+		return append(errs, errors.New("no weather data available"))
+	}
+	data := w.data
+	report := w.report
+
+	messageProfile := profiles[v.Profile]
+	messages, err := evaluator.Evaluate(data, &messageProfile)
+	statusTracker.Report(status.Evaluator, err)
+	var evaluationError *evaluator.EvaluationError
+	if errors.As(err, &evaluationError) {
+		metrics.EvaluationErrors.Add(float64(len(evaluationError.Errors)))
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// Convert to HTML templates to allow HTML tags to pass through
+	templateMessages := make([]template.HTML, len(messages))
+	for i := range messages {
+		templateMessages[i] = template.HTML(messages[i])
+	}
+
+	now := time.Now()
+	content := server.Content{
+		Messages:        templateMessages,
+		Version:         version,
+		CreationTime:    now.Format(time.RFC850),
+		Location:        v.Location.String(),
+		WeatherIconURL:  report.WeatherIconURL,
+		FontAwesomeIcon: report.FontAwesomeIcon,
+		WeatherReport:   fmt.Sprintf("%.0f°C", data.Current.Temperature) + " - " + report.Description,
+	}
+
+	state, ok := renderStates[v.ID]
+	if !ok {
+		state = &renderState{}
+		renderStates[v.ID] = state
+	}
+
+	contentHash := content.Hash()
+	if !force && contentHash == state.contentHash {
+		logger.Info("Content didn't change, skipping rendering")
+		return append(errs, publishHeartbeat(logger, v)...)
+	}
+
+	return append(errs, renderVariant(logger, v, state, content, now, force)...)
+}
+
+// renderVariant renders the content of a variant and publishes the resulting image
+// if it differs from the one published before or force is set. The render state is
+// only updated once all targets received the image, so failed images are published again.
+func renderVariant(logger *log.Entry, v *devices.Variant, state *renderState, content server.Content, now time.Time, force bool) []error {
+	errs := []error{}
+	webServer.UpdateData(v.ID, &content)
+	imageProcessor := imageProcessors[v.ID]
+	err := imageProcessor.Update(runContext, logger, documentFor(logger, v, content))
+	statusTracker.Report(status.Imaging, err)
+	if err != nil {
+		logger.Error("Could not render image: ", err)
+		return append(errs, err)
+	}
+
+	image := server.Image{
+		Data:   imageProcessor.GetImageAsBinary(),
+		Accent: imageProcessor.GetAccentAsBinary(),
+		Gray:   imageProcessor.GetImage(),
+		Format: imageProcessor.Format(),
+		Color:  imageProcessor.GetColorImage(),
+	}
+	metrics.ImageBytes.WithLabelValues(v.ID).Set(float64(len(image.Data) + len(image.Accent)))
+	hash := sha256.New()
+	hash.Write(image.Data)
+	hash.Write(image.Accent)
+	imageHash := hex.EncodeToString(hash.Sum(nil))
+	if !force && imageHash == state.imageHash {
+		logger.Info("Image didn't change, skipping publishing")
+		state.contentHash = content.Hash()
+		return append(errs, publishHeartbeat(logger, v)...)
+	}
+
+	image.Version = now.UTC().Format(time.RFC3339)
+	if r := imageProcessor.Refresh(); r != nil {
+		refresh := *r
+		refresh.Version = image.Version
+		if !refresh.Full {
+			refresh.BaseVersion = state.version
+		}
+		image.Refresh = &refresh
+	}
+	webServer.UpdateImage(v.ID, &image)
+	registry.SetVersion(v, image.Version)
+
+	frameID := mqttClient.NewFrameID()
+	for _, t := range publishTargets(v) {
+		err = publishImage(logger, t, &image, frameID, content.CreationTime)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		// Devices may still display an older image, so don't send regions relative to this one
+		imageProcessor.ResetRefresh()
+		return errs
+	}
+	state.contentHash = content.Hash()
+	state.imageHash = imageHash
+	state.version = image.Version
+	return errs
+}
+
+// documentFor describes content the same way the variant's layout displays it.
+// The page is rendered from memory, so it doesn't depend on the web server.
+func documentFor(logger *log.Entry, v *devices.Variant, content server.Content) *imaging.Document {
+	doc := imaging.Document{
+		AssetDir: server.StaticDir,
+		Greeting: "Hey there.",
+		Icon:     content.FontAwesomeIcon,
+		Report:   content.WeatherReport,
+		Footer: []string{
+			fmt.Sprintf("Displaying data for %s from %s", content.Location, content.CreationTime),
+			"?2w " + content.Version,
+		},
+	}
+	for _, m := range content.Messages {
+		doc.Messages = append(doc.Messages, string(m))
+	}
+
+	var page bytes.Buffer
+	err := server.RenderPage(&page, v.Layout, &content)
+	if err != nil {
+		// Renderers that need the page will fail, the native one doesn't
+		logger.Warn("Could not render page: ", err)
+	} else {
+		doc.HTML = page.String()
+	}
+	return &doc
+}
+
+type publishTarget struct {
+	topic       string
+	url         string
+	compression string
+}
+
+// publishTargets returns the MQTT topics a variant is published to and the image URL
+// and compression for each of them
+func publishTargets(v *devices.Variant) []publishTarget {
+	targets := []publishTarget{}
+	if v.ID == devices.DefaultVariantID {
+		targets = append(targets, publishTarget{
+			topic:       config.MQTTConfig.BaseTopic,
+			url:         imageURL(nil),
+			compression: config.MQTTConfig.Compression,
+		})
+	}
+	for _, d := range registry.DevicesOf(v) {
+		t := publishTarget{topic: d.Config.MQTTTopic, url: imageURL(d), compression: d.Config.Compression}
+		if t.compression == "" {
+			t.compression = config.MQTTConfig.Compression
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// publishHeartbeat tells the clients of a variant that the image didn't change
+func publishHeartbeat(logger *log.Entry, v *devices.Variant) []error {
+	errs := []error{}
+	for _, t := range publishTargets(v) {
+		err := mqttClient.PostHeartbeat(t.topic)
+		statusTracker.Report(status.MQTT, err)
+		if err != nil {
+			logger.Error("Was not able to post heartbeat to MQTT broker: ", err)
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// publishImage publishes an image to a target. frameID is the same for all targets of the image.
+func publishImage(logger *log.Entry, t publishTarget, image *server.Image, frameID uint32, currentDateString string) error {
+	data, accent, format, err := compressImage(image, t.compression)
+	// Partial refreshes only send the chunks of the changed regions
+	partial := image.Refresh != nil && !image.Refresh.Full
+	if err == nil {
+		err = mqttClient.Post(logger, t.topic, frameID, data, accent, currentDateString, !partial)
+	}
+	if err == nil {
+		err = mqttClient.PostFormat(t.topic, format)
+	}
+	if err == nil && image.Refresh != nil {
+		err = publishRegions(logger, t.topic, image.Refresh, frameID, t.compression)
+	}
+	if err != nil {
+		logger.Error("Was not able to post image to MQTT broker: ", err)
+		statusTracker.Report(status.MQTT, err)
+		return err
+	}
+	err = mqttClient.PostImageURL(t.topic, t.url)
+	if err != nil {
+		logger.Error("Was not able to post image URL to MQTT broker: ", err)
+	}
+	statusTracker.Report(status.MQTT, err)
+	return err
+}
+
+// compressImage compresses the planes of an image and marks the format accordingly
+func compressImage(image *server.Image, encoding string) ([]byte, []byte, imaging.Format, error) {
+	format := image.Format
+	if !compression.Compressed(encoding) {
+		return image.Data, image.Accent, format, nil
+	}
+	format.Encoding = encoding
+
+	data, err := compression.Encode(encoding, image.Data)
+	if err != nil {
+		return nil, nil, format, err
+	}
+	var accent []byte
+	if image.Accent != nil {
+		accent, err = compression.Encode(encoding, image.Accent)
+	}
+	return data, accent, format, err
+}
+
+// publishRegions publishes the regions of a partial refresh, compressed like the complete
+// image, and their manifest
+func publishRegions(logger *log.Entry, topic string, refresh *imaging.Refresh, frameID uint32, encoding string) error {
+	data := [][]byte{}
+	var accent [][]byte
+	for _, r := range refresh.Regions {
+		d, err := compression.Encode(encoding, r.Data)
+		if err != nil {
+			return err
+		}
+		data = append(data, d)
+		if r.Accent != nil {
+			a, err := compression.Encode(encoding, r.Accent)
+			if err != nil {
+				return err
+			}
+			accent = append(accent, a)
+		}
+	}
+	return mqttClient.PostRegions(logger, topic, frameID, refresh.Manifest(), data, accent)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"testing"
+	"time"
+
+	"github.com/dschanoeh/what-to-wear/devices"
+	"github.com/dschanoeh/what-to-wear/imaging"
+	"github.com/dschanoeh/what-to-wear/mqtt"
+	"github.com/dschanoeh/what-to-wear/server"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeToken completes immediately with err
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool {
+	return true
+}
+
+func (t *fakeToken) WaitTimeout(time.Duration) bool {
+	return true
+}
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (t *fakeToken) Error() error {
+	return t.err
+}
+
+// fakeClient records the topics published to. Publishing fails with err if it is set.
+type fakeClient struct {
+	paho.Client
+	topics map[string]bool
+	err    error
+}
+
+func (f *fakeClient) IsConnected() bool {
+	return true
+}
+
+func (f *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	f.topics[topic] = true
+	return &fakeToken{err: f.err}
+}
+
+func TestRenderVariantRetriesFailedPublish(t *testing.T) {
+	var err error
+	config.MQTTConfig = mqtt.MQTTConfig{BaseTopic: "test"}
+	registry, err = devices.New(nil, devices.Location{}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webServer = server.New(server.ServerConfig{}, registry, currentStatus)
+	client := &fakeClient{topics: map[string]bool{}, err: errors.New("connection lost")}
+	mqttClient, err = mqtt.NewWithClient(&config.MQTTConfig, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := registry.Variants()[0]
+	imageProcessors[v.ID], err = imaging.New(&imaging.ImageConfig{
+		Renderer:       imaging.RendererNative,
+		Width:          200,
+		Height:         100,
+		PartialRefresh: imaging.PartialRefreshConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imageProcessors[v.ID].Close()
+
+	logger := log.WithField("test", t.Name())
+	state := &renderState{}
+	content := server.Content{Messages: []template.HTML{"Take an umbrella."}}
+	if errs := renderVariant(logger, v, state, content, time.Now(), false); len(errs) == 0 {
+		t.Fatal("The failed publish should have been reported")
+	}
+	if state.contentHash != "" || state.imageHash != "" || state.version != "" {
+		t.Errorf("The state shouldn't record an image that wasn't delivered: %+v", state)
+	}
+
+	client.err = nil
+	client.topics = map[string]bool{}
+	if errs := renderVariant(logger, v, state, content, time.Now(), false); len(errs) != 0 {
+		t.Fatal("Unexpected errors: ", errs)
+	}
+	if !client.topics["test/data"] || client.topics["test/heartbeat"] {
+		t.Errorf("The image should have been published again, got %v", client.topics)
+	}
+	if refresh := imageProcessors[v.ID].Refresh(); refresh == nil || !refresh.Full {
+		t.Errorf("The image should replace the whole display after a failed publish, got %+v", refresh)
+	}
+	if state.contentHash != content.Hash() || state.version == "" {
+		t.Errorf("The state should record the delivered image: %+v", state)
+	}
+}